@@ -0,0 +1,281 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+ #include <stdlib.h>
+ #include <pthread.h>
+ #include <db.h>
+*/
+import "C"
+
+// Callback determining whether the process or thread of control with
+// the given identifiers is still alive. If processOnly is set, only
+// the process needs to be checked.
+type IsAliveFunc func(pid int, tid uint64, processOnly bool) bool
+
+// Callback identifying the current process and thread of control.
+type ThreadIDFunc func() (pid int, tid uint64)
+
+// Check whether a process is still alive by sending it a null signal.
+// A process that may not be signalled exists and counts as alive.
+// Threads of live processes are assumed to be alive as well.
+func ProcessIsAlive(pid int, tid uint64, processOnly bool) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Identify the current process and thread of control like Berkeley DB
+// does by default.
+func currentThreadID() (pid int, tid uint64) {
+	return os.Getpid(), threadIDToUint64(C.db_threadid_t(C.pthread_self()))
+}
+
+// Convert a thread identifier to an integer. The identifier may be an
+// integer or a pointer depending on the platform, so its bytes are
+// copied rather than converted.
+func threadIDToUint64(tid C.db_threadid_t) (v uint64) {
+	n := unsafe.Sizeof(tid)
+	if n > unsafe.Sizeof(v) {
+		n = unsafe.Sizeof(v)
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&v)), n), unsafe.Slice((*byte)(unsafe.Pointer(&tid)), n))
+	return
+}
+
+// Convert an integer back to a thread identifier.
+func uint64ToThreadID(v uint64) (tid C.db_threadid_t) {
+	n := unsafe.Sizeof(tid)
+	if n > unsafe.Sizeof(v) {
+		n = unsafe.Sizeof(v)
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&tid)), n), unsafe.Slice((*byte)(unsafe.Pointer(&v)), n))
+	return
+}
+
+// Go callbacks installed in an environment.
+type envCallbacks struct {
+	isAlive  IsAliveFunc
+	threadID ThreadIDFunc
+	logger   *slog.Logger
+	errpfx   *C.char
+
+	lastErrorLock sync.Mutex
+	lastErrors    map[C.pthread_t][]string // Messages of nested scopes by thread.
+}
+
+var (
+	callbacks     = make(map[*C.DB_ENV]*envCallbacks)
+	callbacksLock sync.RWMutex
+)
+
+// Register the callbacks of an environment. Callbacks left behind by a
+// closed environment that was allocated at the same address are
+// replaced.
+func registerCallbacks(ptr *C.DB_ENV, cbs *envCallbacks) {
+	callbacksLock.Lock()
+	defer callbacksLock.Unlock()
+
+	cbs.lastErrors = make(map[C.pthread_t][]string)
+	callbacks[ptr] = cbs
+}
+
+// Prepare to forget the callbacks of an environment whose handle is
+// about to be closed. Berkeley DB may still call them while the handle
+// is closed, so they stay registered until the returned function is
+// called once the handle is gone. It forgets the callbacks, unless a
+// new environment allocated at the same address has registered its
+// own in the meantime, and releases the memory referenced by the
+// environment on their behalf.
+func unregisterCallbacks(ptr *C.DB_ENV) (release func()) {
+	callbacksLock.RLock()
+	cbs := callbacks[ptr]
+	callbacksLock.RUnlock()
+
+	release = func() {
+		if cbs == nil {
+			return
+		}
+
+		callbacksLock.Lock()
+		if callbacks[ptr] == cbs {
+			delete(callbacks, ptr)
+		}
+		callbacksLock.Unlock()
+
+		if cbs.errpfx != nil {
+			C.free(unsafe.Pointer(cbs.errpfx))
+		}
+	}
+	return
+}
+
+// Find the callbacks of an environment.
+func lookupCallbacks(ptr *C.DB_ENV) (cbs *envCallbacks) {
+	callbacksLock.RLock()
+	defer callbacksLock.RUnlock()
+
+	cbs = callbacks[ptr]
+	if cbs == nil {
+		cbs = &envCallbacks{}
+	}
+	return
+}
+
+// Collection of the error messages reported by an environment for an
+// operation. Berkeley DB reports messages on the thread of control of
+// the failing call, so the goroutine running the operation is locked
+// to its thread and only messages reported on that thread are
+// collected, starting with none.
+type errorScope struct {
+	cbs    *envCallbacks
+	thread C.pthread_t
+}
+
+// Start collecting the error messages reported by an environment on
+// the current thread of control. Scopes may be nested, in which case
+// messages go to the innermost one; every scope must be ended by the
+// goroutine that started it.
+func captureErrors(ptr *C.DB_ENV) (scope errorScope) {
+	runtime.LockOSThread()
+
+	callbacksLock.RLock()
+	scope.cbs = callbacks[ptr]
+	callbacksLock.RUnlock()
+	if scope.cbs == nil {
+		return
+	}
+
+	scope.thread = C.pthread_self()
+
+	scope.cbs.lastErrorLock.Lock()
+	defer scope.cbs.lastErrorLock.Unlock()
+
+	scope.cbs.lastErrors[scope.thread] = append(scope.cbs.lastErrors[scope.thread], "")
+	return
+}
+
+// Stop collecting error messages and take the last one reported in
+// the scope.
+func (scope errorScope) end() (msg string) {
+	defer runtime.UnlockOSThread()
+
+	if scope.cbs == nil {
+		return
+	}
+
+	scope.cbs.lastErrorLock.Lock()
+	defer scope.cbs.lastErrorLock.Unlock()
+
+	msgs := scope.cbs.lastErrors[scope.thread]
+	msg = msgs[len(msgs)-1]
+	if len(msgs) > 1 {
+		scope.cbs.lastErrors[scope.thread] = msgs[:len(msgs)-1]
+	} else {
+		delete(scope.cbs.lastErrors, scope.thread)
+	}
+	return
+}
+
+//export goprotodbIsAlive
+func goprotodbIsAlive(env *C.DB_ENV, pid C.pid_t, tid C.db_threadid_t, flags C.u_int32_t) C.int {
+	isAlive := lookupCallbacks(env).isAlive
+	if isAlive == nil {
+		isAlive = ProcessIsAlive
+	}
+
+	if isAlive(int(pid), threadIDToUint64(tid), flags&C.DB_MUTEX_PROCESS_ONLY != 0) {
+		return 1
+	}
+	return 0
+}
+
+//export goprotodbErrCall
+func goprotodbErrCall(env *C.DB_ENV, pfx *C.char, msg *C.char) {
+	cbs := lookupCallbacks(env)
+	text := C.GoString(msg)
+
+	cbs.lastErrorLock.Lock()
+	if msgs := cbs.lastErrors[C.pthread_self()]; len(msgs) > 0 {
+		msgs[len(msgs)-1] = text
+	}
+	cbs.lastErrorLock.Unlock()
+
+	switch {
+	case cbs.logger != nil && pfx != nil:
+		cbs.logger.Error(text, "prefix", C.GoString(pfx))
+	case cbs.logger != nil:
+		cbs.logger.Error(text)
+	case pfx != nil:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", C.GoString(pfx), text)
+	default:
+		fmt.Fprintln(os.Stderr, text)
+	}
+}
+
+//export goprotodbMsgCall
+func goprotodbMsgCall(env *C.DB_ENV, msg *C.char) {
+	logger := lookupCallbacks(env).logger
+	if logger == nil {
+		return
+	}
+
+	logger.Info(C.GoString(msg))
+}
+
+//export goprotodbThreadID
+func goprotodbThreadID(env *C.DB_ENV, pidp *C.pid_t, tidp *C.db_threadid_t) {
+	threadID := lookupCallbacks(env).threadID
+	if threadID == nil {
+		threadID = currentThreadID
+	}
+
+	pid, tid := threadID()
+
+	if pidp != nil {
+		*pidp = C.pid_t(pid)
+	}
+	if tidp != nil {
+		*tidp = uint64ToThreadID(tid)
+	}
+}
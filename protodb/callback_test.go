@@ -0,0 +1,53 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestProcessIsAlive(t *testing.T) {
+	if !ProcessIsAlive(os.Getpid(), 0, true) {
+		t.Error("Current process considered dead")
+	}
+
+	// Signalling init is not permitted unless running as root.
+	if !ProcessIsAlive(1, 0, true) {
+		t.Error("Process that may not be signalled considered dead")
+	}
+
+	cmd := exec.Command("true")
+	err := cmd.Run()
+	if err != nil {
+		t.Skip("Cannot run child process:", err)
+	}
+
+	if ProcessIsAlive(cmd.Process.Pid, 0, true) {
+		t.Error("Terminated process considered alive")
+	}
+}
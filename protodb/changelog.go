@@ -0,0 +1,308 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Entry of a change log, describing a change to a record.
+type ChangeRecord struct {
+	Key              *uint32 `protobuf:"fixed32,1,opt,name=key"`
+	Database         *string `protobuf:"bytes,2,opt,name=database"`
+	Kind             *int32  `protobuf:"varint,3,opt,name=kind"`
+	Old              []byte  `protobuf:"bytes,4,opt,name=old"`
+	New              []byte  `protobuf:"bytes,5,opt,name=new"`
+	XXX_unrecognized []byte
+}
+
+func (rec *ChangeRecord) Reset()         { *rec = ChangeRecord{} }
+func (rec *ChangeRecord) String() string { return proto.CompactTextString(rec) }
+func (*ChangeRecord) ProtoMessage()      {}
+
+// Get the offset of the entry in the change log.
+func (rec *ChangeRecord) GetKey() uint32 {
+	if rec != nil && rec.Key != nil {
+		return *rec.Key
+	}
+	return 0
+}
+
+// Get the name of the changed database.
+func (rec *ChangeRecord) GetDatabase() string {
+	if rec != nil && rec.Database != nil {
+		return *rec.Database
+	}
+	return ""
+}
+
+// Get the kind of the change.
+func (rec *ChangeRecord) GetKind() ChangeKind {
+	if rec != nil && rec.Kind != nil {
+		return ChangeKind(*rec.Kind)
+	}
+	return Inserted
+}
+
+// Decode the previous record, which is empty for insertions.
+func (rec *ChangeRecord) DecodeOld(val proto.Message) error {
+	return proto.Unmarshal(rec.Old, val)
+}
+
+// Decode the current record, which is empty for deletions.
+func (rec *ChangeRecord) DecodeNew(val proto.Message) error {
+	return proto.Unmarshal(rec.New, val)
+}
+
+// Key of a change log consumer.
+type changeConsumerKey struct {
+	Name             *string `protobuf:"bytes,1,opt,name=name"`
+	XXX_unrecognized []byte
+}
+
+func (key *changeConsumerKey) Reset()         { *key = changeConsumerKey{} }
+func (key *changeConsumerKey) String() string { return proto.CompactTextString(key) }
+func (*changeConsumerKey) ProtoMessage()      {}
+
+// Offset of a change log consumer.
+type changeConsumer struct {
+	Key              *changeConsumerKey `protobuf:"bytes,1,opt,name=key"`
+	Offset           *uint32            `protobuf:"varint,2,opt,name=offset"`
+	XXX_unrecognized []byte
+}
+
+func (c *changeConsumer) Reset()         { *c = changeConsumer{} }
+func (c *changeConsumer) String() string { return proto.CompactTextString(c) }
+func (*changeConsumer) ProtoMessage()    {}
+
+func (c *changeConsumer) GetOffset() uint32 {
+	if c != nil && c.Offset != nil {
+		return *c.Offset
+	}
+	return 0
+}
+
+// Durable log of the changes to databases opened with it. Every change
+// appends an entry to the log in the same transaction, so the log
+// contains exactly the committed changes; see Watch for the changes
+// that require a Record prototype to be reported. Changes to these
+// databases must therefore be made within a transaction; writes
+// without one fail with ErrInvalid. Consumers keep track of their
+// progress through offsets stored alongside the log.
+//
+// Offsets are record numbers of the queue database, which wrap around
+// after 2^32-1 entries. They are compared accordingly, which is
+// unambiguous as long as the log holds fewer than 2^31 entries.
+type ChangeLog struct {
+	records  Database
+	offsets  Database
+	capacity int // Space for the padded encoding of an entry.
+}
+
+// Create a change log on top of a queue database holding the entries
+// and a B-tree or hash database holding consumer offsets. The records
+// of the queue database must be long enough to hold the largest
+// encoded change, otherwise changes fail with ErrInvalid before they
+// are made; compression and transformers cannot be used with it. The
+// operation fails with ErrInvalid if the queue database is unsuitable.
+func NewChangeLog(records, offsets Database) (log *ChangeLog, err error) {
+	capacity, err := records.queueCapacity(paddedPrefixSize)
+	if err != nil {
+		return
+	}
+
+	log = &ChangeLog{records: records, offsets: offsets, capacity: capacity}
+	log.records.codec = PaddedCodec(records.dataCodec())
+	return
+}
+
+// Check whether an offset lies after another one, taking wraparound
+// into account. The zero offset precedes all entries.
+func offsetAfter(a, b uint32) bool {
+	switch {
+	case b == 0:
+		return a != 0
+	case a == 0:
+		return false
+	}
+	return int32(a-b) > 0
+}
+
+// Get the offset following the given one.
+func nextOffset(offset uint32) uint32 {
+	offset++
+	if offset == 0 {
+		offset = 1
+	}
+	return offset
+}
+
+// Encode a change as an entry of the log. The operation fails with
+// ErrInvalid if the entry does not fit into a record of the log.
+func (log *ChangeLog) entry(db Database, before, after proto.Message) (entry *ChangeRecord, err error) {
+	entry = &ChangeRecord{Kind: proto.Int32(int32(changeKind(before, after)))}
+
+	file, name := db.names()
+	if name != "" {
+		entry.Database = proto.String(name)
+	} else {
+		entry.Database = proto.String(file)
+	}
+
+	if before != nil {
+		entry.Old, err = proto.Marshal(before)
+		if err != nil {
+			return
+		}
+	}
+	if after != nil {
+		entry.New, err = proto.Marshal(after)
+		if err != nil {
+			return
+		}
+	}
+
+	buf, err := log.records.dataCodec().Marshal(entry)
+	if err == nil && len(buf) > log.capacity {
+		err = ErrInvalid
+	}
+
+	return
+}
+
+// Append a change to the log.
+func (log *ChangeLog) append(txn Transaction, db Database, before, after proto.Message) (err error) {
+	entry, err := log.entry(db, before, after)
+	if err != nil {
+		return
+	}
+
+	err = log.records.Put(txn, true, entry)
+	return
+}
+
+// Read up to max entries of the log following the given offset.
+func (log *ChangeLog) Read(txn Transaction, offset uint32, max int) (entries []*ChangeRecord, err error) {
+	cur, err := log.records.Cursor(txn)
+	if err != nil {
+		return
+	}
+	defer cur.Close()
+
+	entry := &ChangeRecord{Key: proto.Uint32(nextOffset(offset))}
+
+	err = cur.Set(entry, true)
+	if IsNotFound(err) {
+		// The entry has not been written yet or has been trimmed.
+		err = cur.Last(entry)
+		if err != nil || !offsetAfter(entry.GetKey(), offset) {
+			if IsNotFound(err) {
+				err = nil
+			}
+			return
+		}
+
+		for err = cur.First(entry); err == nil && !offsetAfter(entry.GetKey(), offset); err = cur.Next(entry) {
+		}
+	}
+
+	for ; err == nil && len(entries) < max; err = cur.Next(entry) {
+		entries = append(entries, entry)
+		entry = &ChangeRecord{}
+	}
+	if IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
+
+// Get the offset of the last entry processed by a consumer, or zero
+// if the consumer is unknown.
+func (log *ChangeLog) Offset(txn Transaction, consumer string) (offset uint32, err error) {
+	c := &changeConsumer{Key: &changeConsumerKey{Name: proto.String(consumer)}}
+
+	err = log.offsets.Get(txn, false, c)
+	if err == nil {
+		offset = c.GetOffset()
+	} else if IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
+
+// Record the offset of the last entry processed by a consumer.
+// Passing the transaction that recorded the results of processing
+// makes them atomic with the progress of the consumer.
+func (log *ChangeLog) Commit(txn Transaction, consumer string, offset uint32) (err error) {
+	err = log.offsets.Put(txn, false, &changeConsumer{
+		Key:    &changeConsumerKey{Name: proto.String(consumer)},
+		Offset: proto.Uint32(offset),
+	})
+	return
+}
+
+// Remove the entries of the log that have been processed by all
+// known consumers.
+func (log *ChangeLog) Trim(txn Transaction) (err error) {
+	cur, err := log.offsets.Cursor(txn)
+	if err != nil {
+		return
+	}
+
+	var low uint32
+	c := &changeConsumer{}
+	first := true
+	for err = cur.First(c); err == nil; err = cur.Next(c) {
+		if first || offsetAfter(low, c.GetOffset()) {
+			low, first = c.GetOffset(), false
+		}
+	}
+	cur.Close()
+	if !IsNotFound(err) {
+		return
+	}
+
+	cur, err = log.records.Cursor(txn)
+	if err != nil {
+		return
+	}
+	defer cur.Close()
+
+	entry := &ChangeRecord{}
+	for err = cur.First(entry); err == nil && !offsetAfter(entry.GetKey(), low); err = cur.Next(entry) {
+		err = cur.Del()
+		if err != nil {
+			return
+		}
+	}
+	if IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,294 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, offsets Database) {
+		records := openJobQueue(t, env, "changes")
+		defer records.Close()
+
+		log, err := NewChangeLog(records, offsets)
+		if err != nil {
+			t.Fatal("Failed to create change log:", err)
+		}
+
+		var db Database
+		err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:    true,
+				Type:      BTree,
+				Name:      "data",
+				InMemory:  true,
+				ChangeLog: log,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		defer db.Close()
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Put(txn, false, rec)
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		abort := errors.New("abort")
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			err := db.Del(txn, rec)
+			if err != nil {
+				return err
+			}
+			return abort
+		})
+		if err != abort {
+			t.Error("Aborted transaction failed:", err)
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			rec.Val = proto.String("again")
+			return db.Put(txn, false, rec)
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		entries, err := log.Read(NoTransaction, 0, 10)
+		if err != nil || len(entries) != 2 {
+			t.Fatal("Change log has wrong entries:", entries, err)
+		}
+		if entries[0].GetKind() != Inserted || entries[0].GetDatabase() != "data" {
+			t.Error("Insertion entry mismatch:", entries[0])
+		}
+		if entries[1].GetKind() != Updated {
+			t.Error("Update entry mismatch:", entries[1])
+		}
+
+		old, cur := &TestRecord{}, &TestRecord{}
+		if entries[1].DecodeOld(old) != nil || entries[1].DecodeNew(cur) != nil {
+			t.Fatal("Failed to decode update entry:", entries[1])
+		}
+		if old.GetVal() != "world" || cur.GetVal() != "again" {
+			t.Error("Update values mismatch:", old, cur)
+		}
+
+		offset, err := log.Offset(NoTransaction, "indexer")
+		if err != nil || offset != 0 {
+			t.Error("Unknown consumer has an offset:", offset, err)
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return log.Commit(txn, "indexer", entries[0].GetKey())
+		})
+		if err != nil {
+			t.Fatal("Commit failed:", err)
+		}
+
+		offset, err = log.Offset(NoTransaction, "indexer")
+		if err != nil || offset != entries[0].GetKey() {
+			t.Error("Consumer offset mismatch:", offset, err)
+		}
+
+		err = env.WithTransaction(nil, log.Trim)
+		if err != nil {
+			t.Error("Trim failed:", err)
+		}
+
+		rest, err := log.Read(NoTransaction, 0, 10)
+		if err != nil || len(rest) != 1 || rest[0].GetKey() != entries[1].GetKey() {
+			t.Error("Trimmed change log has wrong entries:", rest, err)
+		}
+
+		rest, err = log.Read(NoTransaction, offset, 10)
+		if err != nil || len(rest) != 1 || rest[0].GetKey() != entries[1].GetKey() {
+			t.Error("Resumed change log has wrong entries:", rest, err)
+		}
+
+		rest, err = log.Read(NoTransaction, entries[1].GetKey(), 10)
+		if err != nil || len(rest) != 0 {
+			t.Error("Change log has entries past its end:", rest, err)
+		}
+	})
+}
+
+func TestChangeLogSizes(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, offsets Database) {
+		var records, db Database
+		var log *ChangeLog
+		err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+			records, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:       true,
+				Type:         Queue,
+				Name:         "changes",
+				InMemory:     true,
+				RecordLength: 512,
+			})
+			if err != nil {
+				return
+			}
+			log, err = NewChangeLog(records, offsets)
+			if err != nil {
+				return
+			}
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:    true,
+				Type:      BTree,
+				Name:      "data",
+				InMemory:  true,
+				ChangeLog: log,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open databases:", err)
+		}
+		defer records.Close()
+		defer db.Close()
+
+		// Entry sizes around the values of the data header markers.
+		for n := 200; n <= 280; n++ {
+			err = env.WithTransaction(nil, func(txn Transaction) error {
+				return db.Put(txn, false, &TestRecord{
+					Key: &TestRecord_Key{Val: proto.String(strconv.Itoa(n))},
+					Val: proto.String(strings.Repeat("v", n)),
+				})
+			})
+			if err != nil {
+				t.Fatal("Put failed:", n, err)
+			}
+		}
+
+		entries, err := log.Read(NoTransaction, 0, 100)
+		if err != nil || len(entries) != 81 {
+			t.Fatal("Change log has wrong entries:", len(entries), err)
+		}
+		for i, entry := range entries {
+			rec := &TestRecord{}
+			if entry.DecodeNew(rec) != nil || len(rec.GetVal()) != 200+i {
+				t.Error("Entry value mismatch:", i, rec)
+			}
+		}
+	})
+}
+
+func TestChangeLogRejected(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, offsets Database) {
+		_, err := NewChangeLog(offsets, offsets)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Change log on B-tree database accepted:", err)
+		}
+
+		var records, db Database
+		var log *ChangeLog
+		err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+			records, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:       true,
+				Type:         Queue,
+				Name:         "changes",
+				InMemory:     true,
+				RecordLength: 128,
+			})
+			if err != nil {
+				return
+			}
+			log, err = NewChangeLog(records, offsets)
+			if err != nil {
+				return
+			}
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:    true,
+				Type:      BTree,
+				Name:      "data",
+				InMemory:  true,
+				ChangeLog: log,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open databases:", err)
+		}
+		defer records.Close()
+		defer db.Close()
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err = db.Put(NoTransaction, false, rec)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Logged put without transaction accepted:", err)
+		}
+
+		rec.Val = proto.String(strings.Repeat("v", 200))
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Put(txn, false, rec)
+		})
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Put with overlong change log entry accepted:", err)
+		}
+
+		ok, err := db.Exists(NoTransaction, rec)
+		if err != nil || ok {
+			t.Error("Rejected record was stored:", ok, err)
+		}
+
+		entries, err := log.Read(NoTransaction, 0, 10)
+		if err != nil || len(entries) != 0 {
+			t.Error("Change log has entries of rejected changes:", entries, err)
+		}
+	})
+}
+
+func TestChangeLogOffsets(t *testing.T) {
+	if !offsetAfter(1, 0) || offsetAfter(0, 1) || offsetAfter(0, 0) {
+		t.Error("Zero offset does not precede all entries")
+	}
+	if !offsetAfter(2, 1) || offsetAfter(1, 2) || offsetAfter(1, 1) {
+		t.Error("Offsets misordered")
+	}
+	if !offsetAfter(1, 0xffffffff) || offsetAfter(0xffffffff, 1) {
+		t.Error("Offsets misordered across wraparound")
+	}
+	if nextOffset(0xffffffff) != 1 || nextOffset(0) != 1 {
+		t.Error("Offsets do not wrap around to one")
+	}
+}
@@ -0,0 +1,146 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Encoding of record data. Keys are always encoded as protobufs, since
+// their byte representation determines the order of records. Encoded
+// data must not start with one of the bytes 0xf7, 0xfe and 0xff, which
+// mark the headers of metadata, sealed and compressed data; records
+// whose encoding does are rejected with ErrInvalid.
+type Codec interface {
+	// Encode a record.
+	Marshal(val proto.Message) ([]byte, error)
+	// Decode a record, replacing its previous contents.
+	Unmarshal(buf []byte, val proto.Message) error
+}
+
+// Codec using the protobuf encoding; this is the default.
+var ProtoCodec Codec = protoCodec{}
+
+// Codec using the JSON encoding, which is handy for debugging.
+var JSONCodec Codec = jsonCodec{}
+
+// First bytes of the headers of record metadata, sealed and compressed
+// data. None of them can start a valid protobuf encoding since they
+// have an invalid wire type, so data without a header remains
+// readable, and they differ from each other, so the headers can be
+// stacked.
+const (
+	metadataMarker   = 0xf7
+	encryptedMarker  = 0xfe
+	compressedMarker = 0xff
+)
+
+// Check whether encoded data starts with a byte reserved for the
+// headers of stored data.
+func reservedPrefix(buf []byte) bool {
+	if len(buf) == 0 {
+		return false
+	}
+
+	switch buf[0] {
+	case metadataMarker, encryptedMarker, compressedMarker:
+		return true
+	}
+	return false
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Marshal(val proto.Message) ([]byte, error) {
+	return proto.Marshal(val)
+}
+
+func (protoCodec) Unmarshal(buf []byte, val proto.Message) error {
+	return proto.Unmarshal(buf, val)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(val proto.Message) ([]byte, error) {
+	return json.Marshal(val)
+}
+
+func (jsonCodec) Unmarshal(buf []byte, val proto.Message) error {
+	val.Reset()
+	return json.Unmarshal(buf, val)
+}
+
+// Wrap a codec so that decoding ignores trailing padding, as found in
+// the fixed-length records of queue databases. The encoded data is
+// prefixed with its length as a four byte big-endian integer, whose
+// leading zero byte cannot be mistaken for the header of compressed or
+// sealed data.
+func PaddedCodec(inner Codec) Codec {
+	return paddedCodec{inner}
+}
+
+// Length of the prefix of padded data and the largest encoded length
+// that keeps its leading byte zero.
+const (
+	paddedPrefixSize = 4
+	maxPaddedSize    = 1<<24 - 1
+)
+
+type paddedCodec struct {
+	inner Codec
+}
+
+func (codec paddedCodec) Marshal(val proto.Message) (out []byte, err error) {
+	buf, err := codec.inner.Marshal(val)
+	if err != nil {
+		return
+	}
+
+	if len(buf) > maxPaddedSize {
+		err = ErrInvalid
+		return
+	}
+
+	out = make([]byte, paddedPrefixSize+len(buf))
+	binary.BigEndian.PutUint32(out, uint32(len(buf)))
+	copy(out[paddedPrefixSize:], buf)
+	return
+}
+
+func (codec paddedCodec) Unmarshal(buf []byte, val proto.Message) error {
+	if len(buf) < paddedPrefixSize {
+		return ErrInvalid
+	}
+
+	size := binary.BigEndian.Uint32(buf)
+	if size > maxPaddedSize || uint64(size) > uint64(len(buf)-paddedPrefixSize) {
+		return ErrInvalid
+	}
+
+	return codec.inner.Unmarshal(buf[paddedPrefixSize:paddedPrefixSize+int(size)], val)
+}
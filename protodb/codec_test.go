@@ -0,0 +1,145 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+)
+
+// Codec prefixing the protobuf encoding with a fixed byte.
+type prefixCodec byte
+
+func (codec prefixCodec) Marshal(val proto.Message) (out []byte, err error) {
+	buf, err := proto.Marshal(val)
+	if err == nil {
+		out = append([]byte{byte(codec)}, buf...)
+	}
+	return
+}
+
+func (codec prefixCodec) Unmarshal(buf []byte, val proto.Message) error {
+	return proto.Unmarshal(buf[1:], val)
+}
+
+func TestJSONCodec(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Codec: JSONCodec}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, rec0, 0, 1024)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if string(buf) != `{"val":"world"}` {
+			t.Error("Stored data is not JSON:", string(buf))
+		}
+
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get failed:", err)
+		}
+		if *rec0.Val != *rec1.Val {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+	})
+}
+
+func TestPaddedCodec(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{
+		Create:       true,
+		Type:         Queue,
+		RecordLength: 300,
+		Codec:        PaddedCodec(ProtoCodec),
+	}, func(db Database) {
+		// Encoded lengths around the values of the data header markers.
+		for size := 240; size <= 260; size++ {
+			rec0 := &queueJob{Payload: make([]byte, size-3)}
+			for i := range rec0.Payload {
+				rec0.Payload[i] = byte(size)
+			}
+
+			err := db.Put(NoTransaction, true, rec0)
+			if err != nil {
+				t.Error("Put failed:", size, err)
+				continue
+			}
+
+			rec1 := &queueJob{Key: rec0.Key}
+			err = db.Get(NoTransaction, false, rec1)
+			if err != nil {
+				t.Error("Get failed:", size, err)
+			} else if !bytes.Equal(rec0.Payload, rec1.Payload) {
+				t.Error("Retrieved payload mismatch:", size, len(rec1.Payload))
+			}
+		}
+	})
+}
+
+func TestCodecReservedPrefix(t *testing.T) {
+	for _, prefix := range []byte{0xf7, 0xfe, 0xff} {
+		withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Codec: prefixCodec(prefix)}, func(db Database) {
+			err := db.Put(NoTransaction, false, &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("hello")},
+				Val: proto.String("world"),
+			})
+			if !errors.Is(err, ErrInvalid) {
+				t.Error("Put with reserved prefix not rejected:", prefix, err)
+			}
+		})
+	}
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Codec: prefixCodec('x')}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		rec1 := &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil || rec1.GetVal() != "world" {
+			t.Error("Get failed:", rec1, err)
+		}
+	})
+}
@@ -0,0 +1,382 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression of record data.
+type Compressor interface {
+	// Identifier stored along with compressed data. It must be
+	// unique among all registered compressors; zero is reserved for
+	// uncompressed data.
+	ID() byte
+	// Compress a buffer.
+	Compress(buf []byte) ([]byte, error)
+	// Decompress a buffer.
+	Decompress(buf []byte) ([]byte, error)
+}
+
+// Error indicating compressed data with an unregistered compressor.
+var ErrUnknownCompressor = errors.New("protodb: unknown compressor")
+
+// Error indicating compressed data that inflates beyond
+// maxDecompressedSize.
+var ErrDecompressedSize = errors.New("protodb: decompressed data too large")
+
+// Error indicating malformed compressed data.
+var ErrCorruptCompressed = errors.New("protodb: corrupt compressed data")
+
+// Largest size of decompressed data accepted by the built-in
+// compressors, which guards against corrupt or hostile records.
+const maxDecompressedSize = 1 << 28
+
+var (
+	compressors     = make(map[byte]Compressor)
+	compressorsLock sync.RWMutex
+)
+
+// Register a compressor so that data compressed by it can be read
+// from any database, regardless of its configured compressor.
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+
+	compressors[c.ID()] = c
+}
+
+// Find the compressor with the given identifier.
+func lookupCompressor(id byte) (c Compressor, ok bool) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+
+	c, ok = compressors[id]
+	return
+}
+
+// Compressor that stores data uncompressed.
+var NoCompression Compressor = noCompression{}
+
+// Compressor using the DEFLATE algorithm.
+var FlateCompression Compressor = flateCompression{}
+
+// Compressor using the LZ4 block format, which is considerably faster
+// than DEFLATE but compresses less.
+var LZ4Compression Compressor = lz4Compression{}
+
+func init() {
+	RegisterCompressor(FlateCompression)
+	RegisterCompressor(LZ4Compression)
+}
+
+type noCompression struct{}
+
+func (noCompression) ID() byte {
+	return 0
+}
+
+func (noCompression) Compress(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+func (noCompression) Decompress(buf []byte) ([]byte, error) {
+	return buf, nil
+}
+
+type flateCompression struct{}
+
+func (flateCompression) ID() byte {
+	return 1
+}
+
+func (flateCompression) Compress(buf []byte) (out []byte, err error) {
+	var w bytes.Buffer
+
+	fw, err := flate.NewWriter(&w, flate.BestSpeed)
+	if err != nil {
+		return
+	}
+
+	_, err = fw.Write(buf)
+	if err == nil {
+		err = fw.Close()
+	}
+	if err == nil {
+		out = w.Bytes()
+	}
+
+	return
+}
+
+func (flateCompression) Decompress(buf []byte) (out []byte, err error) {
+	fr := flate.NewReader(bytes.NewReader(buf))
+	defer fr.Close()
+
+	out, err = ioutil.ReadAll(io.LimitReader(fr, maxDecompressedSize+1))
+	if err == nil && len(out) > maxDecompressedSize {
+		out, err = nil, ErrDecompressedSize
+	}
+
+	return
+}
+
+// Parameters of the LZ4 block format.
+const (
+	lz4MinMatch     = 4     // Shortest match.
+	lz4MaxOffset    = 65535 // Largest distance of a match.
+	lz4LastLiterals = 5     // Number of bytes at the end that are always literals.
+	lz4MatchLimit   = 12    // Distance from the end at which the last match must start.
+	lz4HashLog      = 14    // Logarithm of the size of the match finder table.
+)
+
+// LZ4 compressed data is a block in the LZ4 format preceded by the
+// length of the uncompressed data as a varint, which the block format
+// does not record itself.
+type lz4Compression struct{}
+
+func (lz4Compression) ID() byte {
+	return 2
+}
+
+func (lz4Compression) Compress(buf []byte) (out []byte, err error) {
+	out = make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(buf)+len(buf)/255+16)
+	out = out[:binary.PutUvarint(out, uint64(len(buf)))]
+
+	// Positions of recently seen four byte sequences, plus one.
+	var table [1 << lz4HashLog]int32
+
+	anchor := 0
+	for i := 0; i < len(buf)-lz4MatchLimit; {
+		seq := binary.LittleEndian.Uint32(buf[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(buf[ref:]) != seq {
+			i++
+			continue
+		}
+
+		n := lz4MinMatch
+		for i+n < len(buf)-lz4LastLiterals && buf[ref+n] == buf[i+n] {
+			n++
+		}
+		for i > anchor && ref > 0 && buf[i-1] == buf[ref-1] {
+			i, ref, n = i-1, ref-1, n+1
+		}
+
+		out = appendLZ4Sequence(out, buf[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+
+	out = appendLZ4Sequence(out, buf[anchor:], 0, 0)
+
+	return
+}
+
+// Append a sequence of literals followed by a match to an LZ4 block.
+// The last sequence of a block has no match, which is indicated by a
+// zero offset.
+func appendLZ4Sequence(out, literals []byte, offset, length int) []byte {
+	token := byte(15 << 4)
+	if len(literals) < 15 {
+		token = byte(len(literals) << 4)
+	}
+	if offset != 0 {
+		if length-lz4MinMatch < 15 {
+			token |= byte(length - lz4MinMatch)
+		} else {
+			token |= 15
+		}
+	}
+
+	out = append(out, token)
+	if len(literals) >= 15 {
+		out = appendLZ4Length(out, len(literals)-15)
+	}
+	out = append(out, literals...)
+
+	if offset != 0 {
+		out = append(out, byte(offset), byte(offset>>8))
+		if length-lz4MinMatch >= 15 {
+			out = appendLZ4Length(out, length-lz4MinMatch-15)
+		}
+	}
+
+	return out
+}
+
+// Append the continuation bytes of a length in an LZ4 block.
+func appendLZ4Length(out []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(n))
+}
+
+// Read the continuation bytes of a length in an LZ4 block and add
+// them to the length given in the token.
+func readLZ4Length(buf []byte, n int) (int, []byte, error) {
+	for {
+		if len(buf) == 0 || n > maxDecompressedSize {
+			return 0, nil, ErrCorruptCompressed
+		}
+
+		b := buf[0]
+		buf = buf[1:]
+		n += int(b)
+		if b != 255 {
+			return n, buf, nil
+		}
+	}
+}
+
+func (lz4Compression) Decompress(buf []byte) (out []byte, err error) {
+	size, k := binary.Uvarint(buf)
+	if k <= 0 {
+		err = ErrCorruptCompressed
+		return
+	} else if size > maxDecompressedSize {
+		err = ErrDecompressedSize
+		return
+	}
+	buf = buf[k:]
+
+	dst := make([]byte, 0, size)
+	for len(buf) > 0 {
+		token := buf[0]
+		buf = buf[1:]
+
+		n := int(token >> 4)
+		if n == 15 {
+			n, buf, err = readLZ4Length(buf, n)
+			if err != nil {
+				return
+			}
+		}
+		if n > len(buf) || uint64(len(dst)+n) > size {
+			err = ErrCorruptCompressed
+			return
+		}
+		dst = append(dst, buf[:n]...)
+		buf = buf[n:]
+
+		// The last sequence ends after its literals.
+		if len(buf) == 0 {
+			break
+		} else if len(buf) < 2 {
+			err = ErrCorruptCompressed
+			return
+		}
+
+		offset := int(buf[0]) | int(buf[1])<<8
+		buf = buf[2:]
+		if offset == 0 || offset > len(dst) {
+			err = ErrCorruptCompressed
+			return
+		}
+
+		n = int(token&15) + lz4MinMatch
+		if token&15 == 15 {
+			n, buf, err = readLZ4Length(buf, n)
+			if err != nil {
+				return
+			}
+		}
+		if uint64(len(dst)+n) > size {
+			err = ErrCorruptCompressed
+			return
+		}
+
+		// Matches may overlap the data they produce.
+		start := len(dst) - offset
+		for i := 0; i < n; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		err = ErrCorruptCompressed
+		return
+	}
+
+	out = dst
+	return
+}
+
+// Compress encoded record data, if compression is configured and
+// actually saves space. Compressed data starts with compressedMarker,
+// see reservedPrefix.
+func (db Database) compress(buf []byte) (out []byte, err error) {
+	out = buf
+
+	c := db.compressor
+	if c == nil || c.ID() == 0 {
+		return
+	}
+
+	cbuf, err := c.Compress(buf)
+	if err != nil || len(cbuf)+2 >= len(buf) {
+		return
+	}
+
+	out = make([]byte, 2, len(cbuf)+2)
+	out[0] = compressedMarker
+	out[1] = c.ID()
+	out = append(out, cbuf...)
+
+	return
+}
+
+// Decompress encoded record data, if it carries a compression header.
+func (db Database) decompress(buf []byte) (out []byte, err error) {
+	if len(buf) < 2 || buf[0] != compressedMarker {
+		out = buf
+		return
+	}
+
+	c := db.compressor
+	if c == nil || c.ID() != buf[1] {
+		var ok bool
+		c, ok = lookupCompressor(buf[1])
+		if !ok {
+			err = ErrUnknownCompressor
+			return
+		}
+	}
+
+	out, err = c.Decompress(buf[2:])
+
+	return
+}
@@ -0,0 +1,158 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Compression: FlateCompression}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String(strings.Repeat("world", 100)),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, rec0, 0, 1024)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if len(buf) < 2 || buf[0] != compressedMarker || buf[1] != FlateCompression.ID() {
+			t.Error("Stored data is not compressed:", buf)
+		}
+
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get failed:", err)
+		}
+		if *rec0.Val != *rec1.Val {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+
+		buf, err = proto.Marshal(&TestRecord{Val: proto.String("plain")})
+		if err != nil {
+			t.Fatal("Marshal failed:", err)
+		}
+
+		err = db.PutPartial(NoTransaction, rec1, 0, 1024, buf)
+		if err != nil {
+			t.Error("Partial put failed:", err)
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get of uncompressed data failed:", err)
+		}
+		if *rec1.Val != "plain" {
+			t.Error("Retrieved uncompressed value mismatch:", rec1)
+		}
+	})
+}
+
+func TestLZ4Compression(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	samples := [][]byte{
+		{},
+		[]byte("short"),
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat("hello world, ", 500)),
+		random,
+		append(append([]byte{}, random[:300]...), random[:300]...),
+	}
+
+	for _, buf := range samples {
+		cbuf, err := LZ4Compression.Compress(buf)
+		if err != nil {
+			t.Error("Compression failed:", err)
+			continue
+		}
+
+		out, err := LZ4Compression.Decompress(cbuf)
+		if err != nil || !bytes.Equal(out, buf) {
+			t.Error("Round trip failed:", len(buf), len(out), err)
+		}
+	}
+
+	cbuf, err := LZ4Compression.Compress([]byte(strings.Repeat("hello world, ", 500)))
+	if err != nil {
+		t.Fatal("Compression failed:", err)
+	}
+	// Truncated data and a match referring to data before the start.
+	for _, bad := range [][]byte{cbuf[:len(cbuf)-1], {8, 0x04, 1, 0}} {
+		_, err = LZ4Compression.Decompress(bad)
+		if !errors.Is(err, ErrCorruptCompressed) {
+			t.Error("Corrupt data not rejected:", err)
+		}
+	}
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Compression: LZ4Compression}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String(strings.Repeat("world", 100)),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, rec0, 0, 1024)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if len(buf) < 2 || buf[0] != compressedMarker || buf[1] != LZ4Compression.ID() {
+			t.Error("Stored data is not compressed:", buf)
+		}
+
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get failed:", err)
+		}
+		if rec1.GetVal() != rec0.GetVal() {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+	})
+}
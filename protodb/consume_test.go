@@ -0,0 +1,137 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Configuration of a queue database for numbered test records.
+var queueConfig = &DatabaseConfig{
+	Create:       true,
+	Type:         Queue,
+	RecordLength: 64,
+	Codec:        PaddedCodec(ProtoCodec),
+}
+
+func TestConsume(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		rec := &NumberedTestRecord{}
+
+		err := db.Consume(NoTransaction, rec, false)
+		if !IsNotFound(err) {
+			t.Error("Consume from empty queue did not fail:", err)
+		}
+
+		err = db.Put(NoTransaction, true,
+			&NumberedTestRecord{Val: proto.String("a")},
+			&NumberedTestRecord{Val: proto.String("b")},
+		)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		err = db.Consume(NoTransaction, rec, false)
+		if err != nil || rec.GetVal() != "a" {
+			t.Error("Consume failed:", rec, err)
+		}
+
+		err = db.Consume(NoTransaction, rec, true)
+		if err != nil || rec.GetVal() != "b" {
+			t.Error("Waiting consume failed:", rec, err)
+		}
+	})
+}
+
+func TestConsumeBatch(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		start := time.Now()
+		recs, err := db.ConsumeBatch(NoTransaction, &NumberedTestRecord{}, 10, 50*time.Millisecond)
+		if err != nil || len(recs) != 0 {
+			t.Error("Batch from empty queue not empty:", recs, err)
+		}
+		if time.Since(start) < 50*time.Millisecond {
+			t.Error("Batch from empty queue did not wait")
+		}
+
+		for _, val := range []string{"a", "b", "c"} {
+			err = db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String(val)})
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+		}
+
+		recs, err = db.ConsumeBatch(NoTransaction, &NumberedTestRecord{}, 2, 0)
+		if err != nil || len(recs) != 2 {
+			t.Fatal("Batch has wrong size:", recs, err)
+		}
+		if recs[0].(*NumberedTestRecord).GetVal() != "a" || recs[1].(*NumberedTestRecord).GetVal() != "b" {
+			t.Error("Batch contents mismatch:", recs)
+		}
+
+		recs, err = db.ConsumeBatch(NoTransaction, &NumberedTestRecord{}, 10, time.Second)
+		if err != nil || len(recs) != 1 || recs[0].(*NumberedTestRecord).GetKey() != 3 {
+			t.Error("Remainder batch mismatch:", recs, err)
+		}
+	})
+}
+
+func TestConsumeBatchInvalid(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		recs, err := db.ConsumeBatch(NoTransaction, nil, 10, 0)
+		if !errors.Is(err, ErrInvalid) || len(recs) != 0 {
+			t.Error("Batch consume without prototype not rejected:", recs, err)
+		}
+	})
+}
+
+func TestConsumeBatchPartial(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		for _, val := range []string{"a", "b", "c"} {
+			err := db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String(val)})
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+		}
+
+		// Corrupt the length prefix of the second record.
+		err := db.PutPartial(NoTransaction, &NumberedTestRecord{Key: proto.Uint32(2)}, 0, 4, []byte{0x7f, 0x7f, 0x7f, 0x7f})
+		if err != nil {
+			t.Fatal("Partial put failed:", err)
+		}
+
+		recs, err := db.ConsumeBatch(NoTransaction, &NumberedTestRecord{}, 10, 0)
+		if err == nil {
+			t.Error("Batch with corrupt record succeeded:", recs)
+		}
+		if len(recs) != 1 || recs[0].(*NumberedTestRecord).GetVal() != "a" {
+			t.Error("Records consumed before the error not returned:", recs)
+		}
+	})
+}
@@ -27,7 +27,9 @@ package protodb
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestCursor(t *testing.T) {
@@ -60,7 +62,7 @@ func TestCursor(t *testing.T) {
 		}
 
 		err = cur.Set(rec, true)
-		if err != ErrNotFound {
+		if !errors.Is(err, ErrNotFound) {
 			t.Error("Illegal cursor set succeeded:", rec, err)
 		}
 
@@ -113,3 +115,113 @@ func TestCursor(t *testing.T) {
 		}
 	})
 }
+
+func TestCursorPosition(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, RecordNumbers: true}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("a")},
+			Val: proto.String("foo"),
+		}
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("b")},
+			Val: proto.String("bar"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0, rec1)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to create cursor:", err)
+		}
+
+		rec := &TestRecord{}
+
+		err = cur.SetPosition(rec, 2)
+		if err != nil {
+			t.Error("Cursor positioning failed:", err)
+		}
+		if *rec1.Key.Val != *rec.Key.Val {
+			t.Error("Retrieved key mismatch:", rec1, rec)
+		}
+
+		pos, err := cur.Position()
+		if err != nil {
+			t.Error("Cursor position failed:", err)
+		}
+		if pos != 2 {
+			t.Error("Cursor position mismatch:", pos)
+		}
+
+		err = cur.Close()
+		if err != nil {
+			t.Error("Cursor close failed:", err)
+		}
+	})
+}
+
+func TestCursorDuplicateCount(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, SortedDuplicates: true}, func(db Database) {
+		for _, val := range []string{"c", "a", "b"} {
+			err := db.Put(NoTransaction, false, &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("dup")},
+				Val: proto.String(val),
+			})
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+		}
+		err := db.Put(NoTransaction, false, &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("single")},
+			Val: proto.String("x"),
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to create cursor:", err)
+		}
+		defer cur.Close()
+
+		rec := &TestRecord{Key: &TestRecord_Key{Val: proto.String("dup")}}
+		err = cur.Set(rec, true)
+		if err != nil || rec.GetVal() != "a" {
+			t.Error("Cursor set did not find first duplicate:", rec, err)
+		}
+
+		n, err := cur.DuplicateCount()
+		if err != nil || n != 3 {
+			t.Error("Duplicate count mismatch:", n, err)
+		}
+
+		rec = &TestRecord{Key: &TestRecord_Key{Val: proto.String("single")}}
+		err = cur.Set(rec, true)
+		if err != nil {
+			t.Fatal("Cursor set failed:", err)
+		}
+
+		n, err = cur.DuplicateCount()
+		if err != nil || n != 1 {
+			t.Error("Duplicate count of unique key mismatch:", n, err)
+		}
+
+		_, err = db.Watch(func(change Change) {})
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Watching database with sorted duplicates accepted:", err)
+		}
+
+		err = db.PutWithTTL(NoTransaction, false, time.Hour, rec)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Duplicate with time to live accepted:", err)
+		}
+
+		count, err := db.DeleteExpired(NoEnvironment, 1)
+		if err != nil || count != 0 {
+			t.Error("Expired duplicates deleted:", count, err)
+		}
+	})
+}
@@ -27,8 +27,12 @@ package protodb
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"log/slog"
 	"os"
 	"reflect"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -36,9 +40,60 @@ import (
  #cgo LDFLAGS: -ldb
  #include <stdlib.h>
  #include <db.h>
+ extern void goprotodbErrCall(const DB_ENV *, const char *, const char *);
+ extern void goprotodbMsgCall(const DB_ENV *, const char *);
+ static inline DB_ENV *db_get_env(DB *db) {
+ 	return db->get_env(db);
+ }
+ static inline void db_set_errcall(DB *db) {
+ 	db->set_errcall(db, goprotodbErrCall);
+ }
+ static inline void db_set_msgcall(DB *db) {
+ 	db->set_msgcall(db, goprotodbMsgCall);
+ }
  static inline int db_set_encrypt(DB *db, const char *passwd, u_int32_t flags) {
  	return db->set_encrypt(db, passwd, flags);
  }
+ static inline int db_set_flags(DB *db, u_int32_t flags) {
+ 	return db->set_flags(db, flags);
+ }
+ static inline int db_get_flags(DB *db, u_int32_t *flags) {
+ 	return db->get_flags(db, flags);
+ }
+ static inline int db_set_pagesize(DB *db, u_int32_t pagesize) {
+ 	return db->set_pagesize(db, pagesize);
+ }
+ static inline int db_set_bt_minkey(DB *db, u_int32_t minkey) {
+ 	return db->set_bt_minkey(db, minkey);
+ }
+ static inline int db_set_h_ffactor(DB *db, u_int32_t ffactor) {
+ 	return db->set_h_ffactor(db, ffactor);
+ }
+ static inline int db_set_h_nelem(DB *db, u_int32_t nelem) {
+ 	return db->set_h_nelem(db, nelem);
+ }
+ static inline int db_set_re_len(DB *db, u_int32_t len) {
+ 	return db->set_re_len(db, len);
+ }
+ static inline int db_set_re_pad(DB *db, int pad) {
+ 	return db->set_re_pad(db, pad);
+ }
+ static inline int db_set_re_source(DB *db, const char *source) {
+ 	return db->set_re_source(db, source);
+ }
+ static inline int db_set_q_extentsize(DB *db, u_int32_t extentsize) {
+ 	return db->set_q_extentsize(db, extentsize);
+ }
+ static inline int db_set_heapsize(DB *db, u_int32_t gbytes, u_int32_t bytes) {
+ 	return db->set_heapsize(db, gbytes, bytes, 0);
+ }
+ static inline int db_set_heap_regionsize(DB *db, u_int32_t npages) {
+ 	return db->set_heap_regionsize(db, npages);
+ }
+ static inline int db_set_nofile(DB *db) {
+ 	DB_MPOOLFILE *mpf = db->get_mpf(db);
+ 	return mpf->set_flags(mpf, DB_MPOOL_NOFILE, 1);
+ }
  static inline int db_open(DB *db, DB_TXN *txn, const char *file, const char *database, DBTYPE type, u_int32_t flags, int mode) {
  	return db->open(db, txn, file, database, type, flags, mode);
  }
@@ -48,6 +103,12 @@ import (
  static inline int db_get_type(DB *db, DBTYPE *type) {
  	return db->get_type(db, type);
  }
+ static inline int db_get_re_len(DB *db, u_int32_t *len) {
+ 	return db->get_re_len(db, len);
+ }
+ static inline int db_get_dbname(DB *db, const char **file, const char **database) {
+ 	return db->get_dbname(db, file, database);
+ }
  static inline int db_put(DB *db, DB_TXN *txn, DBT *key, DBT *data, u_int32_t flags) {
  	return db->put(db, txn, key, data, flags);
  }
@@ -57,6 +118,35 @@ import (
  static inline int db_del(DB *db, DB_TXN *txn, DBT *key, u_int32_t flags) {
  	return db->del(db, txn, key, flags);
  }
+ static inline int db_count(DB *db, DB_TXN *txn, DBTYPE type, u_int32_t flags, db_recno_t *count) {
+ 	void *sp = NULL;
+ 	int rc = db->stat(db, txn, &sp, flags);
+ 	if (rc == 0) {
+ 		switch (type) {
+ 		case DB_BTREE:
+ 		case DB_RECNO:
+ 			*count = ((DB_BTREE_STAT *)sp)->bt_nkeys;
+ 			break;
+ 		case DB_HASH:
+ 			*count = ((DB_HASH_STAT *)sp)->hash_nkeys;
+ 			break;
+ 		case DB_QUEUE:
+ 			*count = ((DB_QUEUE_STAT *)sp)->qs_nkeys;
+ 			break;
+ 		case DB_HEAP:
+ 			*count = ((DB_HEAP_STAT *)sp)->heap_nrecs;
+ 			break;
+ 		default:
+ 			*count = 0;
+ 			break;
+ 		}
+ 		free(sp);
+ 	}
+ 	return rc;
+ }
+ static inline int db_key_range(DB *db, DB_TXN *txn, DBT *key, DB_KEY_RANGE *range, u_int32_t flags) {
+ 	return db->key_range(db, txn, key, range, flags);
+ }
  static inline int db_cursor(DB *db, DB_TXN *txn, DBC **cursor, u_int32_t flags) {
  	return db->cursor(db, txn, cursor, flags);
  }
@@ -66,9 +156,15 @@ import (
  static inline int db_cursor_get(DBC *cur, DBT *key, DBT *data, u_int32_t flags) {
  	return cur->get(cur, key, data, flags);
  }
+ static inline int db_cursor_put(DBC *cur, DBT *key, DBT *data, u_int32_t flags) {
+ 	return cur->put(cur, key, data, flags);
+ }
  static inline int db_cursor_del(DBC *cur, u_int32_t flags) {
  	return cur->del(cur, flags);
  }
+ static inline int db_cursor_count(DBC *cur, db_recno_t *count, u_int32_t flags) {
+ 	return cur->count(cur, count, flags);
+ }
 */
 import "C"
 
@@ -81,32 +177,269 @@ const (
 	Hash     = DatabaseType(C.DB_HASH)
 	Numbered = DatabaseType(C.DB_RECNO)
 	Queue    = DatabaseType(C.DB_QUEUE)
+	Heap     = DatabaseType(C.DB_HEAP)
 	Unknown  = DatabaseType(C.DB_UNKNOWN)
 )
 
 // Database configuration.
 type DatabaseConfig struct {
-	Create          bool         // Create the database, if necessary.
-	Mode            os.FileMode  // File creation mode for the database.
-	Password        string       // Encryption password or an empty string.
-	Name            string       // Identifier of the database inside the file.
-	Type            DatabaseType // Type of database to create
-	ReadUncommitted bool         // Enable support for read-uncommitted isolation.
-	Snapshot        bool         // Enable support for snapshot isolation.
+	Create           bool          // Create the database, if necessary.
+	Exclusive        bool          // Fail if the database already exists.
+	Truncate         bool          // Empty the database when opening it.
+	ReadOnly         bool          // Open the database for reading only.
+	InMemory         bool          // Never write the database to a file.
+	Mode             os.FileMode   // File creation mode for the database.
+	Password         string        // Encryption password or an empty string.
+	PasswordFunc     PasswordFunc  // Callback providing the encryption password.
+	PasswordFile     string        // File containing the encryption password.
+	Encrypted        bool          // Encrypt the database with the password of the environment.
+	Name             string        // Identifier of the database inside the file.
+	Type             DatabaseType  // Type of database to create
+	ReadUncommitted  bool          // Enable support for read-uncommitted isolation.
+	Snapshot         bool          // Enable support for snapshot isolation.
+	Codec            Codec         // Encoding of record data, ProtoCodec if nil.
+	Compression      Compressor    // Compression of record data, none if nil.
+	Transformer      Transformer   // Transformation of stored data, none if nil.
+	ChangeLog        *ChangeLog    // Durable log of the changes made within transactions, if any.
+	TTL              time.Duration // Time to live of records stored by Put, unlimited if zero.
+	Versioned        bool          // Maintain a version counter for every record.
+	Record           proto.Message // Prototype of the stored records, checked when opening.
+	PageSize         uint32        // Size of database pages in bytes, a power of two.
+	BTreeMinKey      uint32        // Minimum number of keys per B-tree page.
+	RecordNumbers    bool          // Maintain logical record numbers in a B-tree.
+	SortedDuplicates bool          // Store records with equal keys side by side, sorted by their data.
+	HashFillFactor   uint32        // Desired number of keys per hash bucket.
+	HashSize         uint32        // Estimated final number of keys in a hash table.
+	RecordLength     uint32        // Length of fixed-length records in queue or numbered databases.
+	RecordPad        *byte         // Padding byte for fixed-length records, a space if nil.
+	QueueExtentSize  uint32        // Number of pages per extent file of a queue database.
+	RecordSource     string        // Flat text file backing a numbered database.
+	HeapSize         uint64        // Maximum size of a heap database in bytes, unlimited if zero.
+	HeapRegionSize   uint32        // Number of pages in a region of a heap database.
+	Logger           *slog.Logger  // Destination of diagnostic messages of a database without environment.
+}
+
+// Error describing an invalid database configuration.
+type ConfigError string
+
+func (err ConfigError) Error() string {
+	return "protodb: invalid database configuration: " + string(err)
+}
+
+// Check the configuration for unsupported combinations of settings.
+func (config *DatabaseConfig) validate() (err error) {
+	if config.ReadOnly && (config.Create || config.Truncate) {
+		err = ConfigError("read-only databases cannot be created or truncated")
+		return
+	}
+	if config.Exclusive && !config.Create {
+		err = ConfigError("exclusive opening requires creation")
+		return
+	}
+	if config.InMemory && config.Truncate {
+		err = ConfigError("in-memory databases cannot be truncated")
+		return
+	}
+
+	if config.PageSize != 0 && (config.PageSize < 512 || config.PageSize > 65536 || config.PageSize&(config.PageSize-1) != 0) {
+		err = ConfigError("page size must be a power of two between 512 and 65536")
+		return
+	}
+
+	only := func(set bool, setting string, dbtypes ...DatabaseType) error {
+		if !set {
+			return nil
+		}
+		for _, dbtype := range dbtypes {
+			if config.Type == dbtype {
+				return nil
+			}
+		}
+		return ConfigError(setting + " does not apply to the database type")
+	}
+
+	for _, err = range []error{
+		only(config.BTreeMinKey != 0, "B-tree minimum keys", BTree),
+		only(config.RecordNumbers, "record numbers", BTree),
+		only(config.SortedDuplicates, "sorted duplicates", BTree, Hash),
+		only(config.HashFillFactor != 0, "hash fill factor", Hash),
+		only(config.HashSize != 0, "hash size", Hash),
+		only(config.RecordLength != 0, "record length", Numbered, Queue),
+		only(config.RecordPad != nil, "record padding", Numbered, Queue),
+		only(config.QueueExtentSize != 0, "queue extent size", Queue),
+		only(len(config.RecordSource) > 0, "record source", Numbered),
+		only(config.HeapSize != 0, "heap size", Heap),
+		only(config.HeapRegionSize != 0, "heap region size", Heap),
+	} {
+		if err != nil {
+			return
+		}
+	}
+
+	if config.BTreeMinKey == 1 {
+		err = ConfigError("B-tree minimum keys must be at least 2")
+		return
+	}
+	if config.RecordPad != nil && config.RecordLength == 0 {
+		err = ConfigError("record padding requires a record length")
+		return
+	}
+	if config.SortedDuplicates && config.RecordNumbers {
+		err = ConfigError("sorted duplicates cannot be combined with record numbers")
+		return
+	}
+	if config.SortedDuplicates && config.tracksRecords() {
+		err = errDuplicateRecords
+		return
+	}
+
+	return
+}
+
+// Error describing record metadata, transformers or change logs
+// configured for a database with sorted duplicates. They rely on every
+// key identifying a single record.
+var errDuplicateRecords = ConfigError("sorted duplicates cannot be combined with versions, time to live, transformers or change logs")
+
+// Check whether the configuration relies on every key identifying a
+// single record.
+func (config *DatabaseConfig) tracksRecords() bool {
+	return config.Versioned || config.TTL != 0 || config.Transformer != nil || config.ChangeLog != nil
+}
+
+// Apply the access method tuning settings of the configuration.
+func (db Database) tune(config *DatabaseConfig) (err error) {
+	if config.PageSize != 0 {
+		err = check(C.db_set_pagesize(db.ptr, C.u_int32_t(config.PageSize)))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.BTreeMinKey != 0 {
+		err = check(C.db_set_bt_minkey(db.ptr, C.u_int32_t(config.BTreeMinKey)))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.HashFillFactor != 0 {
+		err = check(C.db_set_h_ffactor(db.ptr, C.u_int32_t(config.HashFillFactor)))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.HashSize != 0 {
+		err = check(C.db_set_h_nelem(db.ptr, C.u_int32_t(config.HashSize)))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.RecordLength != 0 {
+		err = check(C.db_set_re_len(db.ptr, C.u_int32_t(config.RecordLength)))
+		if err != nil {
+			return
+		}
+
+		if config.RecordPad != nil {
+			err = check(C.db_set_re_pad(db.ptr, C.int(*config.RecordPad)))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if config.QueueExtentSize != 0 {
+		err = check(C.db_set_q_extentsize(db.ptr, C.u_int32_t(config.QueueExtentSize)))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(config.RecordSource) > 0 {
+		csource := C.CString(config.RecordSource)
+		defer C.free(unsafe.Pointer(csource))
+
+		err = check(C.db_set_re_source(db.ptr, csource))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.HeapSize != 0 {
+		err = check(C.db_set_heapsize(db.ptr, C.u_int32_t(config.HeapSize>>30), C.u_int32_t(config.HeapSize&(1<<30-1))))
+		if err != nil {
+			return
+		}
+	}
+
+	if config.HeapRegionSize != 0 {
+		err = check(C.db_set_heap_regionsize(db.ptr, C.u_int32_t(config.HeapRegionSize)))
+		if err != nil {
+			return
+		}
+	}
+
+	return
 }
 
 // Database.
 type Database struct {
-	ptr *C.DB
+	ptr         *C.DB
+	codec       Codec
+	compressor  Compressor
+	transformer Transformer
+	changeLog   *ChangeLog
+	ttl         time.Duration
+	versioned   bool
+	duplicates  bool
+	standalone  bool
+	record      reflect.Type
 }
 
-// Open a database in the given file and environment.
+// Open a database in the given file and environment. If the file name
+// is empty, an anonymous in-memory database is created. Named
+// in-memory databases inside an environment are obtained by leaving
+// the file name empty and setting a name and the in-memory flag in the
+// configuration.
 func OpenDatabase(env Environment, txn Transaction, file string, config *DatabaseConfig) (db Database, err error) {
+	var detail string
+	defer func() {
+		if err != nil {
+			operr := &OpError{Op: "open", File: file, Err: err, Detail: detail}
+			if config != nil {
+				operr.Database = config.Name
+			}
+			if txn != NoTransaction {
+				operr.TxnID = txn.ID()
+			}
+			err = operr
+		}
+	}()
+
+	if config != nil {
+		err = config.validate()
+		if err != nil {
+			return
+		}
+		if config.InMemory && len(file) > 0 {
+			err = ConfigError("in-memory databases cannot have a file")
+			return
+		}
+	}
+
 	err = check(C.db_create(&db.ptr, env.ptr, 0))
 	if err == nil {
 		defer func() {
 			if err != nil && db.ptr != nil {
+				release := func() {}
+				if db.standalone {
+					release = unregisterCallbacks(C.db_get_env(db.ptr))
+				}
 				C.db_close(db.ptr, 0)
+				release()
 				db.ptr = nil
 			}
 		}()
@@ -114,8 +447,29 @@ func OpenDatabase(env Environment, txn Transaction, file string, config *Databas
 		return
 	}
 
+	if env.ptr == nil {
+		var cbs envCallbacks
+		if config != nil {
+			cbs.logger = config.Logger
+		}
+
+		db.standalone = true
+		registerCallbacks(C.db_get_env(db.ptr), &cbs)
+
+		C.db_set_errcall(db.ptr)
+		if cbs.logger != nil {
+			C.db_set_msgcall(db.ptr)
+		}
+	}
+
+	scope := captureErrors(C.db_get_env(db.ptr))
+	defer func() {
+		detail = scope.end()
+	}()
+
 	var mode C.int = 0
 	var flags C.u_int32_t = C.DB_THREAD
+	var dbflags C.u_int32_t = 0
 	var cfile, cpassword, cname *C.char
 	var dbtype C.DBTYPE = C.DB_UNKNOWN
 
@@ -128,13 +482,30 @@ func OpenDatabase(env Environment, txn Transaction, file string, config *Databas
 		if config.Create {
 			flags |= C.DB_CREATE
 		}
+		if config.Exclusive {
+			flags |= C.DB_EXCL
+		}
+		if config.Truncate {
+			flags |= C.DB_TRUNCATE
+		}
+		if config.ReadOnly {
+			flags |= C.DB_RDONLY
+		}
 		if config.Mode != 0 {
 			mode = C.int(config.Mode)
 		}
-		if len(config.Password) > 0 {
-			cpassword := C.CString(config.Password)
+		var password string
+		password, err = resolvePassword(config.Password, config.PasswordFunc, config.PasswordFile)
+		if err != nil {
+			return
+		}
+		if len(password) > 0 {
+			cpassword = C.CString(password)
 			defer C.free(unsafe.Pointer(cpassword))
 		}
+		if config.Encrypted {
+			dbflags |= C.DB_ENCRYPT
+		}
 		if len(config.Name) > 0 {
 			cname = C.CString(config.Name)
 			defer C.free(unsafe.Pointer(cname))
@@ -142,32 +513,162 @@ func OpenDatabase(env Environment, txn Transaction, file string, config *Databas
 		if config.Type != 0 {
 			dbtype = C.DBTYPE(config.Type)
 		}
+		if config.RecordNumbers {
+			dbflags |= C.DB_RECNUM
+		}
+		if config.SortedDuplicates {
+			dbflags |= C.DB_DUPSORT
+		}
 		if config.ReadUncommitted {
 			flags |= C.DB_READ_UNCOMMITTED
 		}
 		if config.Snapshot {
 			flags |= C.DB_MULTIVERSION
 		}
+		if config.Codec != nil {
+			db.codec = config.Codec
+		}
+		if config.Compression != nil {
+			db.compressor = config.Compression
+		}
+		if config.Transformer != nil {
+			db.transformer = config.Transformer
+		}
+		db.changeLog = config.ChangeLog
+		db.ttl = config.TTL
+		db.versioned = config.Versioned
 	}
 
 	if cpassword != nil {
-		err = check(C.db_set_encrypt(db.ptr, cpassword, 0))
+		err = check(C.db_set_encrypt(db.ptr, cpassword, C.DB_ENCRYPT_AES))
+		if err != nil {
+			return
+		}
+	}
+
+	if dbflags != 0 {
+		err = check(C.db_set_flags(db.ptr, dbflags))
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil {
+		err = db.tune(config)
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil && config.InMemory {
+		err = check(C.db_set_nofile(db.ptr))
 		if err != nil {
 			return
 		}
 	}
 
 	err = check(C.db_open(db.ptr, txn.ptr, cfile, cname, dbtype, flags, mode))
+	if err != nil {
+		return
+	}
+
+	err = check(C.db_get_flags(db.ptr, &dbflags))
+	if err != nil {
+		return
+	}
+	db.duplicates = dbflags&C.DB_DUPSORT != 0
+	if db.duplicates && config != nil && config.tracksRecords() {
+		err = errDuplicateRecords
+		return
+	}
+
+	if config != nil && config.Record != nil {
+		_, err = db.checkRecord(config.Record)
+		if err != nil {
+			return
+		}
+
+		db.record = reflect.TypeOf(config.Record).Elem()
+	}
 
 	return
 }
 
+// Get the logger of the environment of the database, or of the
+// database itself if it has no environment, if any.
+func (db Database) logger() *slog.Logger {
+	return lookupCallbacks(C.db_get_env(db.ptr)).logger
+}
+
 // Close the database.
 func (db Database) Close() (err error) {
+	file, name := db.names()
+	cenv := C.db_get_env(db.ptr)
+
+	unwatchAll(db.ptr)
+	unmarkResealed(db.ptr)
+	scope := captureErrors(cenv)
+	release := func() {}
+	if db.standalone {
+		release = unregisterCallbacks(cenv)
+	}
 	err = check(C.db_close(db.ptr, 0))
+	detail := scope.end()
+	release()
+	if err != nil {
+		err = &OpError{Op: "close", File: file, Database: name, Err: err, Detail: detail}
+	}
+
+	return
+}
+
+// Get the file and the name of the database.
+func (db Database) names() (file, name string) {
+	var cfile, cname *C.char
+	if C.db_get_dbname(db.ptr, &cfile, &cname) == 0 {
+		if cfile != nil {
+			file = C.GoString(cfile)
+		}
+		if cname != nil {
+			name = C.GoString(cname)
+		}
+	}
 	return
 }
 
+// Start annotating an error of a database operation with context and
+// the last message reported by Berkeley DB during the operation,
+// unless it has been annotated already. The returned function must be
+// deferred to finish the annotation.
+func (db Database) annotate(op string, txn Transaction, rec *proto.Message, err *error) func() {
+	scope := captureErrors(C.db_get_env(db.ptr))
+
+	return func() {
+		detail := scope.end()
+
+		if *err == nil {
+			return
+		}
+		if _, ok := (*err).(*OpError); ok {
+			return
+		}
+
+		operr := &OpError{Op: op, Err: *err}
+		operr.File, operr.Database = db.names()
+		if rec != nil {
+			operr.Key = recordKeyText(*rec)
+		}
+		if txn != NoTransaction {
+			operr.TxnID = txn.ID()
+		}
+		if !IsNotFound(*err) && !IsKeyExists(*err) {
+			operr.Detail = detail
+		}
+
+		*err = operr
+	}
+}
+
 // Get the type of the database.
 func (db Database) Type() (dbtype DatabaseType, err error) {
 	var cdbtype C.DBTYPE
@@ -176,6 +677,55 @@ func (db Database) Type() (dbtype DatabaseType, err error) {
 	return
 }
 
+// Get the length of fixed-length records in the database, or zero for
+// variable-length records.
+func (db Database) recordLength() (length uint32, err error) {
+	dbtype, err := db.Type()
+	if err != nil {
+		return
+	}
+
+	switch dbtype {
+	case Numbered, Queue:
+		var clength C.u_int32_t
+		err = check(C.db_get_re_len(db.ptr, &clength))
+		length = uint32(clength)
+	}
+
+	return
+}
+
+// Check that a queue database can hold the padded records of a work
+// queue or change log, which rules out compression and transformers.
+// Returns the number of bytes left for the padded encoding of a record
+// after its metadata, if any; unless that exceeds the given overhead
+// of the records, the operation fails with ErrInvalid.
+func (db Database) queueCapacity(overhead int) (capacity int, err error) {
+	dbtype, err := db.Type()
+	if err != nil {
+		return
+	}
+	if dbtype != Queue || db.compressor != nil && db.compressor.ID() != 0 || db.transformer != nil {
+		err = ErrInvalid
+		return
+	}
+
+	length, err := db.recordLength()
+	if err != nil {
+		return
+	}
+
+	capacity = int(length)
+	if db.versioned || db.ttl != 0 {
+		capacity -= maxMetadataSize
+	}
+	if capacity <= overhead {
+		err = ErrInvalid
+	}
+
+	return
+}
+
 // Extract the key from a record.
 func recordKey(rec proto.Message) interface{} {
 	key := reflect.ValueOf(rec).Elem().FieldByName("Key")
@@ -186,6 +736,28 @@ func recordKey(rec proto.Message) interface{} {
 	return key.Interface()
 }
 
+// Describe the key of a record for diagnostic purposes, without
+// modifying the record.
+func recordKeyText(rec proto.Message) (text string) {
+	val := reflect.ValueOf(rec)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return
+	}
+
+	key := val.Elem().FieldByName("Key")
+	if !key.IsValid() || key.Kind() != reflect.Ptr || key.IsNil() {
+		return
+	}
+
+	if msg, ok := key.Interface().(proto.Message); ok {
+		text = strings.TrimSpace(proto.CompactTextString(msg))
+	} else {
+		text = fmt.Sprint(key.Elem().Interface())
+	}
+
+	return
+}
+
 // Obtains a shallow copy of a record without its key.
 func recordWithoutKey(rec proto.Message) proto.Message {
 	data := reflect.ValueOf(rec)
@@ -203,13 +775,16 @@ func recordWithoutKey(rec proto.Message) proto.Message {
 	return data.Interface().(proto.Message)
 }
 
-// Marshal a protobuf struct into a database thang.
-func marshalDBT(dbt *C.DBT, val proto.Message) (err error) {
-	buf, err := proto.Marshal(val)
-	if err != nil {
-		return
+// Get the codec used for the data of records.
+func (db Database) dataCodec() Codec {
+	if db.codec == nil {
+		return ProtoCodec
 	}
+	return db.codec
+}
 
+// Point a database thang at a byte buffer.
+func setDBT(dbt *C.DBT, buf []byte) {
 	if len(buf) > 0 {
 		dbt.data = unsafe.Pointer(&buf[0])
 		dbt.size = C.u_int32_t(len(buf))
@@ -217,24 +792,41 @@ func marshalDBT(dbt *C.DBT, val proto.Message) (err error) {
 		dbt.data = nil
 		dbt.size = 0
 	}
-
-	return
 }
 
-// Marshal the key of a record into a database thang.
-func (db Database) marshalKey(dbt *C.DBT, rec proto.Message) (err error) {
-	key := recordKey(rec)
-
-	dbtype, err := db.Type()
-	if err != nil {
+// Marshal a protobuf struct into a database thang.
+func marshalDBT(dbt *C.DBT, val proto.Message) (err error) {
+	buf, err := proto.Marshal(val)
+	if err != nil {
+		return
+	}
+
+	setDBT(dbt, buf)
+
+	return
+}
+
+// Marshal the key of a record into a database thang.
+func (db Database) marshalKey(dbt *C.DBT, rec proto.Message) (err error) {
+	dbtype, err := db.checkRecord(rec)
+	if err != nil {
 		return
 	}
 
+	key := recordKey(rec)
+
 	switch dbtype {
 	case Numbered, Queue:
 		dbt.data = unsafe.Pointer(key.(*uint32))
 		dbt.size = 4
 
+	case Heap:
+		rid := new(C.DB_HEAP_RID)
+		rid.pgno = C.db_pgno_t(*key.(*uint64) >> 16)
+		rid.indx = C.db_indx_t(*key.(*uint64))
+		dbt.data = unsafe.Pointer(rid)
+		dbt.size = C.DB_HEAP_RID_SZ
+
 	default:
 		err = marshalDBT(dbt, key.(proto.Message))
 	}
@@ -242,9 +834,34 @@ func (db Database) marshalKey(dbt *C.DBT, rec proto.Message) (err error) {
 	return
 }
 
-// Marshal the data of a record into a database thang.
-func (db Database) marshalData(dbt *C.DBT, rec proto.Message) (err error) {
-	err = marshalDBT(dbt, recordWithoutKey(rec))
+// Marshal the data and metadata of a record stored under the given key
+// into a database thang.
+func (db Database) marshalData(key, dbt *C.DBT, rec proto.Message, meta recordMeta) (err error) {
+	_, err = db.checkRecord(rec)
+	if err != nil {
+		return
+	}
+
+	buf, err := db.dataCodec().Marshal(recordWithoutKey(rec))
+	if err != nil {
+		return
+	} else if reservedPrefix(buf) {
+		err = ErrInvalid
+		return
+	}
+
+	buf, err = db.compress(buf)
+	if err != nil {
+		return
+	}
+
+	buf, err = db.seal(C.GoBytes(key.data, C.int(key.size)), buf)
+	if err != nil {
+		return
+	}
+
+	setDBT(dbt, meta.prepend(buf, db.transformer != nil))
+
 	return
 }
 
@@ -257,77 +874,784 @@ func unmarshalDBT(dbt *C.DBT, val proto.Message) (err error) {
 
 // Unmarshal the key of a record from a database thang.
 func (db Database) unmarshalKey(dbt *C.DBT, rec proto.Message) (err error) {
+	dbtype, err := db.checkRecord(rec)
+	if err != nil {
+		return
+	}
+
 	key := recordKey(rec)
 
-	dbtype, err := db.Type()
+	switch dbtype {
+	case Numbered, Queue:
+		if dbt.size == 4 {
+			*key.(*uint32) = *(*uint32)(dbt.data)
+		} else {
+			err = &SchemaError{Record: reflect.TypeOf(rec).String(), Reason: "key size does not match record number data type"}
+		}
+
+	case Heap:
+		if dbt.size == C.DB_HEAP_RID_SZ {
+			rid := (*C.DB_HEAP_RID)(dbt.data)
+			*key.(*uint64) = uint64(rid.pgno)<<16 | uint64(rid.indx)
+		} else {
+			err = &SchemaError{Record: reflect.TypeOf(rec).String(), Reason: "key size does not match record ID data type"}
+		}
+
+	default:
+		err = unmarshalDBT(dbt, key.(proto.Message))
+	}
+
+	return
+}
+
+// Unmarshal the data and metadata of a record stored under the given
+// key from a database thang. Tombstones have no data to unmarshal.
+func (db Database) unmarshalData(key, dbt *C.DBT, rec proto.Message) (meta recordMeta, err error) {
+	meta, buf, err := splitMeta(C.GoBytes(dbt.data, C.int(dbt.size)))
+	if err != nil || meta.deleted {
+		return
+	}
+
+	buf, err = db.open(C.GoBytes(key.data, C.int(key.size)), buf)
+	if err != nil {
+		return
+	}
+
+	buf, err = db.decompress(buf)
+	if err != nil {
+		return
+	}
+
+	err = db.dataCodec().Unmarshal(buf, rec)
+
+	return
+}
+
+// Store records in the database. In combination with a queue,
+// numbered or heap database the append flags causes the keys of the
+// records to be set to fresh record numbers or IDs, for any other
+// database it prevents an existing record with the same key from
+// being overwritten.
+func (db Database) Put(txn Transaction, append bool, recs ...proto.Message) (err error) {
+	err = db.put("put", txn, append, db.ttl, recs)
+	return
+}
+
+// Store records in the database like Put, but let them expire after
+// the given time to live. Expired records are hidden from Get and
+// cursors until they are deleted, but Count, EstimateCount and
+// KeyRange still take them into account until then. Records with a time
+// to live cannot be stored in databases with sorted duplicates; this
+// fails with ErrInvalid.
+func (db Database) PutWithTTL(txn Transaction, append bool, ttl time.Duration, recs ...proto.Message) (err error) {
+	err = db.put("put with ttl", txn, append, ttl, recs)
+	return
+}
+
+func (db Database) put(op string, txn Transaction, append bool, ttl time.Duration, recs []proto.Message) (err error) {
+	var rec proto.Message
+	defer db.annotate(op, txn, &rec, &err)()
+
+	if ttl != 0 && db.duplicates {
+		err = ErrInvalid
+		return
+	}
+
+	dbtype, err := db.Type()
+	if err != nil {
+		return
+	}
+
+	var key, data C.DBT
+	var flags C.u_int32_t = 0
+
+	if append {
+		key.flags |= C.DB_DBT_USERMEM
+
+		switch dbtype {
+		case Numbered, Queue, Heap:
+			flags |= C.DB_APPEND
+		default:
+			flags |= C.DB_NOOVERWRITE
+		}
+	} else {
+		key.flags |= C.DB_DBT_READONLY
+	}
+
+	data.flags |= C.DB_DBT_READONLY
+
+	tracked := db.tracked()
+
+	for _, rec = range recs {
+		var before proto.Message
+		if tracked && !append {
+			before, err = db.previous(txn, rec)
+			if err != nil {
+				return
+			}
+		}
+
+		err = db.checkChange(txn, before, rec)
+		if err != nil {
+			return
+		}
+
+		recflags := flags
+
+		var meta recordMeta
+		if ttl > 0 {
+			meta.expires = time.Now().Add(ttl).UnixNano()
+		}
+		if db.versioned {
+			var overwrite bool
+			meta.version, overwrite, err = db.nextVersion(txn, dbtype, append, rec)
+			if err != nil {
+				return
+			} else if overwrite {
+				recflags &^= C.DB_NOOVERWRITE
+			}
+		}
+
+		err = db.marshalKey(&key, rec)
+		if err == nil {
+			key.ulen = key.size
+		} else {
+			return
+		}
+
+		err = db.marshalData(&key, &data, rec, meta)
+		if err != nil {
+			return
+		}
+
+		err = check(C.db_put(db.ptr, txn.ptr, &key, &data, recflags))
+		if err != nil {
+			return
+		}
+
+		if append && dbtype == Heap {
+			err = db.unmarshalKey(&key, rec)
+			if err != nil {
+				return
+			}
+		}
+
+		if flags&C.DB_APPEND != 0 && db.transformer != nil {
+			// The data was sealed before the key was assigned, so
+			// seal it again bound to the actual key.
+			err = db.marshalKey(&key, rec)
+			if err == nil {
+				err = db.marshalData(&key, &data, rec, meta)
+			}
+			if err == nil {
+				err = check(C.db_put(db.ptr, txn.ptr, &key, &data, 0))
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		if tracked {
+			err = db.track(txn, before, proto.Clone(rec))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Get records from the database. The consume flag makes sense only in
+// combination with a queue database and causes the operation to wait
+// for and obtain the next enqueued record; see Consume and
+// ConsumeBatch for more control.
+func (db Database) Get(txn Transaction, consume bool, recs ...proto.Message) (err error) {
+	var rec proto.Message
+	defer db.annotate("get", txn, &rec, &err)()
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_REALLOC
+	defer func() {
+		C.free(data.data)
+	}()
+
+	for _, rec = range recs {
+		if consume {
+			err = db.consume(txn, rec, C.DB_CONSUME_WAIT)
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		err = db.marshalKey(&key, rec)
+		if err != nil {
+			return
+		}
+
+		err = check(C.db_get(db.ptr, txn.ptr, &key, &data, 0))
+		if err != nil {
+			return
+		}
+
+		var meta recordMeta
+		meta, err = db.unmarshalData(&key, &data, rec)
+		if err != nil {
+			return
+		} else if meta.expired() {
+			db.forget(&key, rec)
+			err = ErrNotFound
+			return
+		}
+
+		err = db.unmarshalKey(&key, rec)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Interval between attempts to consume from an empty queue while
+// waiting with a timeout.
+const consumePollInterval = 10 * time.Millisecond
+
+// Remove the next enqueued record from a queue database and store it
+// in rec. With the wait flag the operation blocks until a record is
+// available, otherwise it fails with ErrNotFound on an empty queue.
+func (db Database) Consume(txn Transaction, rec proto.Message, wait bool) (err error) {
+	defer db.annotate("consume", txn, &rec, &err)()
+
+	var flags C.u_int32_t = C.DB_CONSUME
+	if wait {
+		flags = C.DB_CONSUME_WAIT
+	}
+
+	err = db.consume(txn, rec, flags)
+
+	return
+}
+
+func (db Database) consume(txn Transaction, rec proto.Message, flags C.u_int32_t) (err error) {
+	err = db.checkChange(txn, nil, nil)
+	if err != nil {
+		return
+	}
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_USERMEM
+	data.flags |= C.DB_DBT_REALLOC
+	defer func() {
+		C.free(data.data)
+	}()
+
+	err = db.marshalKey(&key, rec)
+	if err == nil {
+		key.ulen = key.size
+	} else {
+		return
+	}
+
+	// Expired records are removed on the way.
+	for {
+		err = check(C.db_get(db.ptr, txn.ptr, &key, &data, flags))
+		if err != nil {
+			return
+		}
+
+		var meta recordMeta
+		meta, err = db.unmarshalData(&key, &data, rec)
+		if err != nil {
+			return
+		}
+
+		err = db.unmarshalKey(&key, rec)
+		if err != nil {
+			return
+		}
+
+		if db.tracked() {
+			err = db.track(txn, proto.Clone(rec), nil)
+			if err != nil {
+				return
+			}
+		}
+
+		if !meta.expired() {
+			return
+		}
+		rec.Reset()
+	}
+}
+
+// Discard the decoded data of an expired record, so that only its key
+// is left as if it had not been found.
+func (db Database) forget(key *C.DBT, rec proto.Message) {
+	rec.Reset()
+	db.unmarshalKey(key, rec)
+}
+
+// Remove up to max enqueued records from a queue database. The
+// records are fresh instances of the type of the prototype. If the
+// queue is empty, the operation waits up to the given timeout for the
+// first record, or indefinitely if the timeout is negative; it then
+// takes whatever else is available without waiting. If an error
+// occurs, the records consumed before it are returned along with it;
+// without a transaction they have been removed from the queue already.
+//
+// An indefinite wait blocks inside Berkeley DB until a record arrives,
+// but a bounded wait polls the queue every consumePollInterval, so it
+// may notice a new record up to that much later and keeps the calling
+// goroutine busy until the timeout.
+func (db Database) ConsumeBatch(txn Transaction, prototype proto.Message, max int, timeout time.Duration) (recs []proto.Message, err error) {
+	var rec proto.Message
+	defer db.annotate("consume batch", txn, &rec, &err)()
+
+	protoType := reflect.TypeOf(prototype)
+	if protoType == nil || protoType.Kind() != reflect.Ptr {
+		err = ErrInvalid
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	recType := protoType.Elem()
+
+	for len(recs) < max {
+		rec = reflect.New(recType).Interface().(proto.Message)
+
+		switch {
+		case len(recs) > 0 || timeout == 0:
+			err = db.consume(txn, rec, C.DB_CONSUME)
+		case timeout < 0:
+			err = db.consume(txn, rec, C.DB_CONSUME_WAIT)
+		default:
+			for {
+				err = db.consume(txn, rec, C.DB_CONSUME)
+				if !IsNotFound(err) || !time.Now().Before(deadline) {
+					break
+				}
+				time.Sleep(consumePollInterval)
+			}
+		}
+
+		if IsNotFound(err) {
+			rec, err = nil, nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		recs = append(recs, rec)
+	}
+
+	return
+}
+
+// Delete records from the database. In versioned databases other than
+// queues, a deleted record leaves a tombstone keeping its version,
+// which is hidden like an expired record but never swept; see
+// GetVersion.
+func (db Database) Del(txn Transaction, recs ...proto.Message) (err error) {
+	var rec proto.Message
+	defer db.annotate("del", txn, &rec, &err)()
+
+	var key C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+
+	tracked := db.tracked()
+
+	tombstones, err := db.tombstones()
+	if err != nil {
+		return
+	}
+
+	for _, rec = range recs {
+		var before proto.Message
+		if tracked {
+			before, err = db.previous(txn, rec)
+			if err != nil {
+				return
+			}
+		}
+
+		err = db.checkChange(txn, before, nil)
+		if err != nil {
+			return
+		}
+
+		err = db.marshalKey(&key, rec)
+		if err != nil {
+			return
+		}
+
+		if tombstones {
+			err = db.bury(txn, &key, rec)
+		} else {
+			err = check(C.db_del(db.ptr, txn.ptr, &key, 0))
+		}
+		if err != nil {
+			return
+		}
+
+		if tracked {
+			err = db.track(txn, before, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Replace a record of a versioned database by its tombstone. The
+// operation fails with ErrNotFound if there is no record or only a
+// tombstone.
+func (db Database) bury(txn Transaction, key *C.DBT, rec proto.Message) (err error) {
+	meta, found, err := db.storedMeta(txn, rec, db.rmw())
+	if err != nil {
+		return
+	} else if !found || meta.deleted {
+		err = ErrNotFound
+		return
+	}
+
+	var data C.DBT
+	data.flags |= C.DB_DBT_READONLY
+	setDBT(&data, tombstone(meta))
+
+	err = check(C.db_put(db.ptr, txn.ptr, key, &data, 0))
+	return
+}
+
+// Check whether a record with the key of the given one exists in the
+// database and has not expired. Only the metadata header of the data
+// is transferred and nothing is decoded.
+func (db Database) Exists(txn Transaction, rec proto.Message) (ok bool, err error) {
+	defer db.annotate("exists", txn, &rec, &err)()
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_MALLOC
+	data.dlen = maxMetadataSize
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = check(C.db_get(db.ptr, txn.ptr, &key, &data, 0))
+	switch err {
+	case nil:
+		meta, _, _ := splitMeta(C.GoBytes(data.data, C.int(data.size)))
+		C.free(data.data)
+		ok = !meta.expired()
+	case ErrNotFound, ErrKeyEmpty:
+		err = nil
+	}
+
+	return
+}
+
+// Count the records in the database. Numbered databases and B-tree
+// databases with record numbers maintain the count, other databases
+// are traversed to take it. Expired records count until they are
+// deleted, see DeleteExpired, and so do the tombstones of versioned
+// databases.
+func (db Database) Count(txn Transaction) (count int, err error) {
+	defer db.annotate("count", txn, nil, &err)()
+
+	flags, err := db.countFlags()
+	if err != nil {
+		return
+	}
+
+	count, err = db.count(txn, flags)
+	return
+}
+
+// Get the statistics flags yielding an exact count of the records at
+// the lowest cost. Only numbered databases and B-tree databases with
+// record numbers keep the count in their fast statistics.
+func (db Database) countFlags() (flags C.u_int32_t, err error) {
+	dbtype, err := db.Type()
+	if err != nil {
+		return
+	}
+
+	var dbflags C.u_int32_t
+	err = check(C.db_get_flags(db.ptr, &dbflags))
+	if err != nil {
+		return
+	}
+
+	if dbtype == Numbered || dbtype == BTree && dbflags&C.DB_RECNUM != 0 {
+		flags = C.DB_FAST_STAT
+	}
+	return
+}
+
+// Count the records in the database using the statistics obtained
+// with the given flags.
+func (db Database) count(txn Transaction, flags C.u_int32_t) (count int, err error) {
+	dbtype, err := db.Type()
+	if err != nil {
+		return
+	}
+
+	var ccount C.db_recno_t
+	err = check(C.db_count(db.ptr, txn.ptr, C.DBTYPE(dbtype), flags, &ccount))
+	count = int(ccount)
+
+	return
+}
+
+// Proportions of the keys in a B-tree database that are less than,
+// equal to and greater than a given key. The proportions lie between
+// zero and one and add up to one.
+type KeyRange struct {
+	Less    float64
+	Equal   float64
+	Greater float64
+}
+
+// Estimate the position of the key of the given record within the
+// database. This operation only makes sense in combination with a
+// B-tree database. Like Count, it takes expired records into account
+// until they are deleted.
+func (db Database) KeyRange(txn Transaction, rec proto.Message) (kr KeyRange, err error) {
+	defer db.annotate("key range", txn, &rec, &err)()
+
+	var key C.DBT
+	var ckr C.DB_KEY_RANGE
+
+	key.flags |= C.DB_DBT_READONLY
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = check(C.db_key_range(db.ptr, txn.ptr, &key, &ckr, 0))
+	if err != nil {
+		return
+	}
+
+	kr.Less = float64(ckr.less)
+	kr.Equal = float64(ckr.equal)
+	kr.Greater = float64(ckr.greater)
+
+	return
+}
+
+// Estimate the number of records with keys greater than or equal to
+// that of from and less than that of to. A nil record stands for the
+// respective end of the database. The estimate is scaled by the exact
+// number of records, which is maintained by B-tree databases with
+// record numbers but requires a full traversal of the database
+// statistics otherwise. Like Count, it takes expired records into
+// account until they are deleted.
+func (db Database) EstimateCount(txn Transaction, from, to proto.Message) (count int, err error) {
+	defer db.annotate("estimate count", txn, &from, &err)()
+
+	lower, upper := 0.0, 1.0
+
+	if from != nil {
+		var kr KeyRange
+		kr, err = db.KeyRange(txn, from)
+		if err != nil {
+			return
+		}
+		lower = kr.Less
+	}
+	if to != nil {
+		var kr KeyRange
+		kr, err = db.KeyRange(txn, to)
+		if err != nil {
+			return
+		}
+		upper = kr.Less
+	}
+
+	if upper <= lower {
+		return
+	}
+
+	statflags, err := db.countFlags()
+	if err != nil {
+		return
+	}
+
+	total, err := db.count(txn, statflags)
+	if err != nil {
+		return
+	}
+
+	count = int((upper-lower)*float64(total) + 0.5)
+
+	return
+}
+
+// Get part of the raw stored data of a record without decoding it. At
+// most length bytes starting at the given offset are returned; fewer
+// bytes are returned if the stored data ends before that.
+func (db Database) GetPartial(txn Transaction, rec proto.Message, offset, length int) (buf []byte, err error) {
+	defer db.annotate("get partial", txn, &rec, &err)()
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_MALLOC | C.DB_DBT_PARTIAL
+	data.doff = C.u_int32_t(offset)
+	data.dlen = C.u_int32_t(length)
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = check(C.db_get(db.ptr, txn.ptr, &key, &data, 0))
+	if err != nil {
+		return
+	}
+	defer C.free(data.data)
+
+	buf = C.GoBytes(data.data, C.int(data.size))
+
+	return
+}
+
+// Replace part of the raw stored data of a record without decoding
+// it. The length bytes starting at the given offset are replaced by
+// buf, growing or shrinking the stored data as necessary. The record
+// is created if it does not exist yet. In combination with a queue
+// database the length of the data must not change. Since the metadata
+// of records would not be maintained, this operation fails with
+// ErrInvalid on versioned databases, databases with a default time to
+// live and records stored with a time to live.
+func (db Database) PutPartial(txn Transaction, rec proto.Message, offset, length int, buf []byte) (err error) {
+	defer db.annotate("put partial", txn, &rec, &err)()
+
+	if db.versioned || db.ttl != 0 {
+		err = ErrInvalid
+		return
+	}
+
+	meta, _, err := db.storedMeta(txn, rec, 0)
+	if err != nil {
+		return
+	} else if meta != (recordMeta{}) {
+		err = ErrInvalid
+		return
+	}
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_READONLY | C.DB_DBT_PARTIAL
+	data.doff = C.u_int32_t(offset)
+	data.dlen = C.u_int32_t(length)
+
+	if len(buf) > 0 {
+		data.data = unsafe.Pointer(&buf[0])
+		data.size = C.u_int32_t(len(buf))
+	}
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = db.checkChange(txn, nil, nil)
 	if err != nil {
 		return
 	}
 
-	switch dbtype {
-	case Numbered, Queue:
-		if dbt.size == 4 {
-			*key.(*uint32) = *(*uint32)(dbt.data)
-		} else {
-			panic("key size does not match record number data type")
+	tracked := db.tracked()
+
+	var before, after proto.Message
+	if tracked {
+		before, err = db.previous(txn, rec)
+		if err != nil {
+			return
 		}
+	}
 
-	default:
-		err = unmarshalDBT(dbt, key.(proto.Message))
+	err = check(C.db_put(db.ptr, txn.ptr, &key, &data, 0))
+	if err != nil || !tracked {
+		return
 	}
 
-	return
-}
+	after, err = db.previous(txn, rec)
+	if err == nil {
+		err = db.track(txn, before, after)
+	}
 
-// Unmarshal the data of a record from a database thang.
-func (db Database) unmarshalData(dbt *C.DBT, rec proto.Message) (err error) {
-	err = unmarshalDBT(dbt, rec)
 	return
 }
 
-// Store records in the database. In combination with a queue or
-// numbered database the append flags causes the keys of the records
-// to be set to fresh record numbers, for any other database it
-// prevents an existing record with the same key from being
-// overwritten.
-func (db Database) Put(txn Transaction, append bool, recs ...proto.Message) (err error) {
-	dbtype, err := db.Type()
+// Determine the size of the raw stored data of a record without
+// transferring it. Missing records have size zero.
+func (db Database) dataSize(txn Transaction, rec proto.Message) (size int, err error) {
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_USERMEM
+
+	err = db.marshalKey(&key, rec)
 	if err != nil {
 		return
 	}
 
-	var key, data C.DBT
-	var flags C.u_int32_t = 0
+	err = check(C.db_get(db.ptr, txn.ptr, &key, &data, 0))
+	switch err {
+	case nil, ErrBufferTooSmall:
+		size = int(data.size)
+		err = nil
+	case ErrNotFound, ErrKeyEmpty:
+		err = nil
+	}
 
-	if append {
-		key.flags |= C.DB_DBT_USERMEM
+	return
+}
 
-		switch dbtype {
-		case Numbered, Queue:
-			flags |= C.DB_APPEND
-		default:
-			flags |= C.DB_NOOVERWRITE
-		}
-	} else {
-		key.flags |= C.DB_DBT_READONLY
+// Append the encoded data of records to the data already stored
+// under their keys without reading it back. Since concatenated
+// protobuf encodings are merged when decoded, this appends to
+// repeated fields and replaces singular ones. Records that do not
+// exist yet are created. This operation cannot be used with queue
+// databases, compression, transformers or record metadata, like
+// PutPartial, and only makes sense with a protobuf codec.
+func (db Database) AppendData(txn Transaction, recs ...proto.Message) (err error) {
+	var rec proto.Message
+	defer db.annotate("append data", txn, &rec, &err)()
+
+	if db.compressor != nil && db.compressor.ID() != 0 || db.transformer != nil {
+		err = ErrInvalid
+		return
 	}
 
-	data.flags |= C.DB_DBT_READONLY
-
-	for _, rec := range recs {
-		err = db.marshalData(&data, rec)
+	for _, rec = range recs {
+		var size int
+		size, err = db.dataSize(txn, rec)
 		if err != nil {
 			return
 		}
 
-		err = db.marshalKey(&key, rec)
-		if err == nil {
-			key.ulen = key.size
-		} else {
+		var buf []byte
+		buf, err = db.dataCodec().Marshal(recordWithoutKey(rec))
+		if err != nil {
 			return
 		}
 
-		err = check(C.db_put(db.ptr, txn.ptr, &key, &data, flags))
+		err = db.PutPartial(txn, rec, size, 0, buf)
 		if err != nil {
 			return
 		}
@@ -336,66 +1660,133 @@ func (db Database) Put(txn Transaction, append bool, recs ...proto.Message) (err
 	return
 }
 
-// Get records from the database. The consume flag makes sense only in
-// combination with a queue database and causes the operation to wait
-// for and obtain the next enqueued record.
-func (db Database) Get(txn Transaction, consume bool, recs ...proto.Message) (err error) {
-	var key, data C.DBT
-	var flags C.u_int32_t = 0
+// Reapply the transformer of the database to the data of all stored
+// records, for example to encrypt them with the current key after a
+// key rotation, examining at most batch records per transaction.
+// Without an environment, no transactions are used. Records are not
+// decoded in the process, unless their changes are reported to
+// watchers and change logs. Once all records have been resealed, the
+// database handle rejects data the transformer did not produce, if the
+// transformer supports that. This operation cannot be used with queue
+// databases.
+func (db Database) Reseal(env Environment, batch int) (count int, err error) {
+	defer db.annotate("reseal", NoTransaction, nil, &err)()
+
+	if db.transformer == nil {
+		return
+	}
 
-	if consume {
-		key.flags |= C.DB_DBT_USERMEM
-		flags |= C.DB_CONSUME_WAIT
+	count, err = db.batches(env, batch, db.reseal)
+	if err == nil {
+		db.markResealed()
+	}
+
+	return
+}
+
+// Reseal up to batch records following the given raw key, or from the
+// start of the database. Returns the key to continue after and whether
+// the end of the database has been reached.
+func (db Database) reseal(txn Transaction, after []byte, batch int) (next []byte, resealed int, done bool, err error) {
+	cur, err := db.Cursor(txn)
+	if err == nil {
+		defer func() {
+			cerr := cur.Close()
+			if err == nil {
+				err = cerr
+			}
+		}()
 	} else {
-		key.flags |= C.DB_DBT_READONLY
+		return
 	}
 
-	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	flags, err := cur.resume(after)
+	if err != nil {
+		return
+	} else if flags == C.DB_NEXT {
+		next = after
+	}
 
-	for _, rec := range recs {
-		err = db.marshalKey(&key, rec)
-		if err == nil {
-			key.ulen = key.size
-		} else {
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_REALLOC
+	data.flags |= C.DB_DBT_REALLOC
+	defer func() {
+		C.free(key.data)
+		C.free(data.data)
+	}()
+
+	for i := 0; i < batch; i++ {
+		err = cur.get(&key, &data, flags)
+		if IsNotFound(err) {
+			err = nil
+			done = true
+			return
+		} else if err != nil {
 			return
 		}
 
-		err = check(C.db_get(db.ptr, txn.ptr, &key, &data, flags))
+		flags = C.DB_NEXT
+
+		raw := C.GoBytes(key.data, C.int(key.size))
+
+		var meta recordMeta
+		var buf []byte
+		meta, buf, err = splitMeta(C.GoBytes(data.data, C.int(data.size)))
 		if err != nil {
 			return
+		} else if meta.deleted {
+			next = raw
+			continue
 		}
 
-		err = db.unmarshalData(&data, rec)
+		buf, err = db.transformer.Open(raw, buf)
 		if err != nil {
 			return
 		}
-		
-		err = db.unmarshalKey(&key, rec)
+
+		buf, err = db.transformer.Seal(raw, buf)
 		if err != nil {
 			return
 		}
-	}
-
-	return
-}
 
-// Delete records from the database.
-func (db Database) Del(txn Transaction, recs ...proto.Message) (err error) {
-	var key C.DBT
+		var sealed C.DBT
+		sealed.flags |= C.DB_DBT_READONLY
+		setDBT(&sealed, meta.prepend(buf, true))
 
-	key.flags |= C.DB_DBT_READONLY
+		var rec proto.Message
+		if db.tracked() {
+			rec = db.newRecord()
+		}
+		if rec != nil {
+			_, err = db.unmarshalData(&key, &data, rec)
+			if err == nil {
+				err = db.unmarshalKey(&key, rec)
+			}
+			if err != nil {
+				return
+			}
+		}
 
-	for _, rec := range recs {
-		err = db.marshalKey(&key, rec)
+		err = db.checkChange(txn, rec, rec)
 		if err != nil {
 			return
 		}
 
-		err = check(C.db_del(db.ptr, txn.ptr, &key, 0))
+		err = check(C.db_cursor_put(cur.ptr, &key, &sealed, C.DB_CURRENT))
 		if err != nil {
 			return
 		}
+
+		if rec != nil {
+			err = db.track(txn, rec, proto.Clone(rec))
+			if err != nil {
+				return
+			}
+		}
+
+		next = raw
+		resealed++
 	}
 
 	return
@@ -403,19 +1794,103 @@ func (db Database) Del(txn Transaction, recs ...proto.Message) (err error) {
 
 // Database cursor.
 type Cursor struct {
-	db Database
-	ptr *C.DBC
+	db      Database
+	txn     Transaction
+	ptr     *C.DBC
+	fetched *reflect.Type // Type of the records retrieved last.
 }
 
 // Obtain a cursor over the database.
 func (db Database) Cursor(txn Transaction) (cur Cursor, err error) {
+	defer db.annotate("cursor", txn, nil, &err)()
+
 	cur.db = db
+	cur.txn = txn
+	cur.fetched = new(reflect.Type)
 	err = check(C.db_cursor(db.ptr, txn.ptr, &cur.ptr, 0))
 	return
 }
 
+// Remember the type of a record retrieved through the cursor.
+func (cur Cursor) remember(rec proto.Message) {
+	*cur.fetched = reflect.TypeOf(rec).Elem()
+}
+
+// Create an empty record of the type retrieved through the cursor last
+// or, failing that, of the type stored in the database. Returns nil if
+// neither is known.
+func (cur Cursor) newRecord() proto.Message {
+	if *cur.fetched != nil {
+		return reflect.New(*cur.fetched).Interface().(proto.Message)
+	}
+	return cur.db.newRecord()
+}
+
+// Move the cursor and retrieve raw data.
+func (cur Cursor) get(key, data *C.DBT, flags C.u_int32_t) error {
+	return check(C.db_cursor_get(cur.ptr, key, data, flags))
+}
+
+// Position the cursor at the record with the given raw key to resume
+// a pass over the database after it. Returns the flags to retrieve the
+// first record to examine with, which start over from the beginning
+// if there is no key or the record has vanished meanwhile.
+func (cur Cursor) resume(after []byte) (flags C.u_int32_t, err error) {
+	flags = C.DB_FIRST
+	if after == nil {
+		return
+	}
+
+	var start, data C.DBT
+	start.flags |= C.DB_DBT_READONLY
+	setDBT(&start, after)
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_USERMEM
+
+	err = cur.get(&start, &data, C.DB_SET)
+	if err == nil {
+		flags = C.DB_NEXT
+	} else if IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
+
+// Retrieve the record at the current position of the cursor, even if
+// it has expired.
+func (cur Cursor) current(rec proto.Message) (err error) {
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_REALLOC
+	data.flags |= C.DB_DBT_REALLOC
+	defer func() {
+		C.free(key.data)
+		C.free(data.data)
+	}()
+
+	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_CURRENT))
+	if err != nil {
+		return
+	}
+
+	_, err = cur.db.unmarshalData(&key, &data, rec)
+	if err != nil {
+		return
+	}
+
+	err = cur.db.unmarshalKey(&key, rec)
+	return
+}
+
+// Annotate an error of a cursor operation with context.
+func (cur Cursor) annotate(op string, rec *proto.Message, err *error) func() {
+	return cur.db.annotate(op, cur.txn, rec, err)
+}
+
 // Close the cursor.
 func (cur Cursor) Close() (err error) {
+	defer cur.annotate("cursor close", nil, &err)()
+
 	err = check(C.db_cursor_close(cur.ptr))
 	return
 }
@@ -425,6 +1900,10 @@ func (cur Cursor) Close() (err error) {
 // to the given one is fetched; this operation mode only makes sense
 // in combination with a B-tree database.
 func (cur Cursor) Set(rec proto.Message, exact bool) (err error) {
+	defer cur.annotate("cursor set", &rec, &err)()
+
+	cur.remember(rec)
+
 	var key, data C.DBT
 	var flags C.u_int32_t = 0
 
@@ -437,14 +1916,16 @@ func (cur Cursor) Set(rec proto.Message, exact bool) (err error) {
 	}
 
 	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	defer func() {
+		C.free(data.data)
+	}()
 
 	err = cur.db.marshalKey(&key, rec)
 	if err == nil {
-		odata := key.data
+		okey := key.data
 		defer func() {
-			if key.data != odata {
-				C.free(data.data)
+			if key.data != okey {
+				C.free(key.data)
 			}
 		}()
 	} else {
@@ -456,32 +1937,55 @@ func (cur Cursor) Set(rec proto.Message, exact bool) (err error) {
 		return
 	}
 
-	err = cur.db.unmarshalData(&data, rec)
+	meta, err := cur.db.unmarshalData(&key, &data, rec)
 	if err != nil {
 		return
+	} else if meta.expired() {
+		if exact {
+			cur.db.forget(&key, rec)
+			err = ErrNotFound
+		} else {
+			err = cur.move(rec, C.DB_NEXT, C.DB_NEXT)
+		}
+		return
 	}
 
 	err = cur.db.unmarshalKey(&key, rec)
 	return
 }
 
-// Retrieve the first record of the database.
-func (cur Cursor) First(rec proto.Message) (err error) {
+// Move the cursor and retrieve the record at the new position. Expired
+// records are skipped by moving further as indicated by skip.
+func (cur Cursor) move(rec proto.Message, flags, skip C.u_int32_t) (err error) {
+	cur.remember(rec)
+
 	var key, data C.DBT
 
 	key.flags |= C.DB_DBT_REALLOC
-	defer C.free(key.data)
 	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	defer func() {
+		C.free(key.data)
+		C.free(data.data)
+	}()
 
-	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_FIRST))
-	if err != nil {
-		return
-	}
+	for skipped := false; ; skipped = true {
+		err = check(C.db_cursor_get(cur.ptr, &key, &data, flags))
+		if err != nil {
+			if skipped {
+				rec.Reset()
+			}
+			return
+		}
 
-	err = cur.db.unmarshalData(&data, rec)
-	if err != nil {
-		return
+		var meta recordMeta
+		meta, err = cur.db.unmarshalData(&key, &data, rec)
+		if err != nil {
+			return
+		} else if !meta.expired() {
+			break
+		}
+
+		flags = skip
 	}
 
 	err = cur.db.unmarshalKey(&key, rec)
@@ -489,23 +1993,141 @@ func (cur Cursor) First(rec proto.Message) (err error) {
 	return
 }
 
+// Retrieve the first record of the database.
+func (cur Cursor) First(rec proto.Message) (err error) {
+	defer cur.annotate("cursor first", nil, &err)()
+
+	err = cur.move(rec, C.DB_FIRST, C.DB_NEXT)
+	return
+}
+
 // Retrieve the next record from the cursor.
 func (cur Cursor) Next(rec proto.Message) (err error) {
+	defer cur.annotate("cursor next", nil, &err)()
+
+	err = cur.move(rec, C.DB_NEXT, C.DB_NEXT)
+	return
+}
+
+// Retrieve the last record of the database.
+func (cur Cursor) Last(rec proto.Message) (err error) {
+	defer cur.annotate("cursor last", nil, &err)()
+
+	err = cur.move(rec, C.DB_LAST, C.DB_PREV)
+	return
+}
+
+// Retrieve the previous record from the cursor.
+func (cur Cursor) Prev(rec proto.Message) (err error) {
+	defer cur.annotate("cursor prev", nil, &err)()
+
+	err = cur.move(rec, C.DB_PREV, C.DB_PREV)
+	return
+}
+
+// Move the cursor and retrieve only the key of the record at the new
+// position. Only the metadata header of the record data is
+// transferred, to skip expired records as indicated by skip.
+func (cur Cursor) getKey(rec proto.Message, flags, skip C.u_int32_t) (err error) {
+	cur.remember(rec)
+
 	var key, data C.DBT
 
 	key.flags |= C.DB_DBT_REALLOC
-	defer C.free(key.data)
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_REALLOC
+	data.dlen = maxMetadataSize
+	defer func() {
+		C.free(key.data)
+		C.free(data.data)
+	}()
+
+	for {
+		err = check(C.db_cursor_get(cur.ptr, &key, &data, flags))
+		if err != nil {
+			return
+		}
+
+		meta, _, _ := splitMeta(C.GoBytes(data.data, C.int(data.size)))
+		if !meta.expired() {
+			break
+		}
+
+		flags = skip
+	}
+
+	err = cur.db.unmarshalKey(&key, rec)
+
+	return
+}
+
+// Retrieve only the key of the first record of the database.
+func (cur Cursor) FirstKey(rec proto.Message) (err error) {
+	defer cur.annotate("cursor first key", nil, &err)()
+
+	err = cur.getKey(rec, C.DB_FIRST, C.DB_NEXT)
+	return
+}
+
+// Retrieve only the key of the next record from the cursor.
+func (cur Cursor) NextKey(rec proto.Message) (err error) {
+	defer cur.annotate("cursor next key", nil, &err)()
+
+	err = cur.getKey(rec, C.DB_NEXT, C.DB_NEXT)
+	return
+}
+
+// Retrieve only the key of the last record of the database.
+func (cur Cursor) LastKey(rec proto.Message) (err error) {
+	defer cur.annotate("cursor last key", nil, &err)()
+
+	err = cur.getKey(rec, C.DB_LAST, C.DB_PREV)
+	return
+}
+
+// Retrieve only the key of the previous record from the cursor.
+func (cur Cursor) PrevKey(rec proto.Message) (err error) {
+	defer cur.annotate("cursor prev key", nil, &err)()
+
+	err = cur.getKey(rec, C.DB_PREV, C.DB_PREV)
+	return
+}
+
+// Retrieve the record at the given logical position, counting from
+// one. This operation only makes sense in combination with a B-tree
+// database maintaining record numbers.
+func (cur Cursor) SetPosition(rec proto.Message, pos uint32) (err error) {
+	defer cur.annotate("cursor set position", nil, &err)()
+
+	cur.remember(rec)
+
+	var key, data C.DBT
+
+	recno := C.db_recno_t(pos)
+	key.data = unsafe.Pointer(&recno)
+	key.size = C.u_int32_t(unsafe.Sizeof(recno))
+	key.flags |= C.DB_DBT_MALLOC
+	defer func() {
+		if key.data != unsafe.Pointer(&recno) {
+			C.free(key.data)
+		}
+	}()
 	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	defer func() {
+		C.free(data.data)
+	}()
 
-	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_NEXT))
+	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_SET_RECNO))
 	if err != nil {
 		return
 	}
 
-	err = cur.db.unmarshalData(&data, rec)
+	meta, err := cur.db.unmarshalData(&key, &data, rec)
 	if err != nil {
 		return
+	} else if meta.expired() {
+		rec.Reset()
+		err = ErrNotFound
+		return
 	}
 
 	err = cur.db.unmarshalKey(&key, rec)
@@ -513,56 +2135,98 @@ func (cur Cursor) Next(rec proto.Message) (err error) {
 	return
 }
 
-// Retrieve the last record of the database.
-func (cur Cursor) Last(rec proto.Message) (err error) {
+// Get the logical position of the current record at the cursor,
+// counting from one. This operation only makes sense in combination
+// with a B-tree database maintaining record numbers.
+func (cur Cursor) Position() (pos uint32, err error) {
+	defer cur.annotate("cursor position", nil, &err)()
+
 	var key, data C.DBT
+	var recno C.db_recno_t
 
-	key.flags |= C.DB_DBT_REALLOC
-	defer C.free(key.data)
-	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	key.flags |= C.DB_DBT_PARTIAL
+	data.data = unsafe.Pointer(&recno)
+	data.ulen = C.u_int32_t(unsafe.Sizeof(recno))
+	data.flags |= C.DB_DBT_USERMEM
+
+	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_GET_RECNO))
+	pos = uint32(recno)
+
+	return
+}
+
+// Count the duplicate data items stored under the key of the current
+// record at the cursor.
+func (cur Cursor) DuplicateCount() (count int, err error) {
+	defer cur.annotate("cursor duplicate count", nil, &err)()
+
+	var ccount C.db_recno_t
+	err = check(C.db_cursor_count(cur.ptr, &ccount, 0))
+	count = int(ccount)
+	return
+}
+
+// Delete the current record at the cursor, leaving a tombstone in
+// versioned databases like Del.
+func (cur Cursor) Del() (err error) {
+	defer cur.annotate("cursor del", nil, &err)()
+
+	var before proto.Message
+	if cur.db.tracked() {
+		before = cur.newRecord()
+	}
+	if before != nil {
+		err = cur.current(before)
+		if err != nil {
+			return
+		}
+	}
 
-	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_LAST))
+	err = cur.db.checkChange(cur.txn, before, nil)
 	if err != nil {
 		return
 	}
 
-	err = cur.db.unmarshalData(&data, rec)
+	tombstones, err := cur.db.tombstones()
 	if err != nil {
 		return
+	} else if tombstones {
+		err = cur.bury()
+	} else {
+		err = check(C.db_cursor_del(cur.ptr, 0))
+	}
+	if err == nil && before != nil {
+		err = cur.db.track(cur.txn, before, nil)
 	}
-
-	err = cur.db.unmarshalKey(&key, rec)
 
 	return
 }
 
-// Retrieve the previous record from the cursor.
-func (cur Cursor) Prev(rec proto.Message) (err error) {
+// Replace the current record at the cursor by its tombstone.
+func (cur Cursor) bury() (err error) {
 	var key, data C.DBT
 
-	key.flags |= C.DB_DBT_REALLOC
-	defer C.free(key.data)
-	data.flags |= C.DB_DBT_REALLOC
-	defer C.free(data.data)
+	key.flags |= C.DB_DBT_PARTIAL
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_REALLOC
+	data.dlen = maxMetadataSize
+	defer func() {
+		C.free(data.data)
+	}()
 
-	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_PREV))
+	err = check(C.db_cursor_get(cur.ptr, &key, &data, C.DB_CURRENT))
 	if err != nil {
 		return
 	}
 
-	err = cur.db.unmarshalData(&data, rec)
+	meta, _, err := splitMeta(C.GoBytes(data.data, C.int(data.size)))
 	if err != nil {
 		return
 	}
 
-	err = cur.db.unmarshalKey(&key, rec)
-
-	return
-}
+	var stone C.DBT
+	stone.flags |= C.DB_DBT_READONLY
+	setDBT(&stone, tombstone(meta))
 
-// Delete the current record at the cursor.
-func (cur Cursor) Del() (err error) {
-	err = check(C.db_cursor_del(cur.ptr, 0))
+	err = check(C.db_cursor_put(cur.ptr, &key, &stone, C.DB_CURRENT))
 	return
 }
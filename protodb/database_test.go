@@ -26,16 +26,28 @@
 package protodb
 
 import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Run an action with a database that is removed afterwards.
 func withDb(t *testing.T, dbtype DatabaseType, action func(Database)) {
-	db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
-		Create: true,
-		Type:   dbtype,
-	})
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: dbtype}, action)
+}
+
+// Run an action with a specially configured database that is removed
+// afterwards.
+func withDbConfig(t *testing.T, config *DatabaseConfig, action func(Database)) {
+	db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", config)
 	if err == nil {
 		defer os.Remove("test.db")
 	} else {
@@ -50,10 +62,225 @@ func withDb(t *testing.T, dbtype DatabaseType, action func(Database)) {
 	}
 }
 
-// Run an action with an environment and a transactional database that
-// are removed afterwards.
+// Run an action with a private in-memory transactional environment
+// with locking.
+func withEnv(t *testing.T, action func(Environment)) {
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Locking:       true,
+		Private:       true,
+		InMemoryLogs:  true,
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	action(env)
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
+
+// Run an action with a private in-memory environment and a
+// transactional in-memory database.
 func withEnvDb(t *testing.T, dbtype DatabaseType, action func(Environment, Database)) {
-	err := os.Mkdir("test.env", 0755)
+	withEnv(t, func(env Environment) {
+		var db Database
+		err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:   true,
+				Type:     dbtype,
+				Name:     "test",
+				InMemory: true,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+
+		action(env, db)
+
+		err = db.Close()
+		if err != nil {
+			t.Error("Failed to close database:", err)
+		}
+	})
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:      true,
+		Type:        Hash,
+		BTreeMinKey: 4,
+	})
+	var cerr ConfigError
+	if !errors.As(err, &cerr) {
+		t.Error("Invalid configuration accepted:", err)
+	}
+
+	_, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:   true,
+		Type:     BTree,
+		PageSize: 1000,
+	})
+	if !errors.As(err, &cerr) {
+		t.Error("Invalid page size accepted:", err)
+	}
+
+	_, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:           true,
+		Type:             BTree,
+		RecordNumbers:    true,
+		SortedDuplicates: true,
+	})
+	if !errors.As(err, &cerr) {
+		t.Error("Sorted duplicates with record numbers accepted:", err)
+	}
+
+	for _, config := range []*DatabaseConfig{
+		{Create: true, Type: BTree, SortedDuplicates: true, Versioned: true},
+		{Create: true, Type: BTree, SortedDuplicates: true, TTL: time.Hour},
+		{Create: true, Type: Hash, SortedDuplicates: true, Transformer: markerTransformer{}},
+	} {
+		_, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", config)
+		if !errors.As(err, &cerr) {
+			t.Error("Sorted duplicates with record tracking accepted:", config, err)
+		}
+	}
+
+	db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:           true,
+		Type:             BTree,
+		SortedDuplicates: true,
+	})
+	if err == nil {
+		defer os.Remove("test.db")
+	} else {
+		t.Fatal("Failed to create database with sorted duplicates:", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("Failed to close database:", err)
+	}
+
+	_, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{TTL: time.Hour})
+	if !errors.As(err, &cerr) {
+		t.Error("Existing database with sorted duplicates reopened with time to live:", err)
+	}
+}
+
+func TestRecordLength(t *testing.T) {
+	pad := byte(0)
+
+	for _, config := range []*DatabaseConfig{
+		{Create: true, Type: Queue, RecordLength: 16},
+		{Create: true, Type: Queue, RecordLength: 16, RecordPad: &pad},
+	} {
+		withDbConfig(t, config, func(db Database) {
+			rec := &NumberedTestRecord{Val: proto.String("a")}
+			err := db.Put(NoTransaction, true, rec)
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+
+			buf, err := db.GetPartial(NoTransaction, rec, 0, 1024)
+			if err != nil || len(buf) != 16 {
+				t.Fatal("Stored record has wrong length:", buf, err)
+			}
+
+			want := byte(' ')
+			if config.RecordPad != nil {
+				want = *config.RecordPad
+			}
+			for _, b := range buf[3:] {
+				if b != want {
+					t.Error("Stored record has wrong padding:", buf)
+					break
+				}
+			}
+
+			err = db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String(strings.Repeat("v", 16))})
+			if err == nil {
+				t.Error("Overlong record accepted")
+			}
+		})
+	}
+}
+
+func TestQueueExtentSize(t *testing.T) {
+	defer func() {
+		files, _ := filepath.Glob("__dbq.test.db.*")
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: Queue, RecordLength: 64, QueueExtentSize: 1, Codec: PaddedCodec(ProtoCodec)}, func(db Database) {
+		err := db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String("a")})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		files, err := filepath.Glob("__dbq.test.db.*")
+		if err != nil || len(files) == 0 {
+			t.Error("Queue extent files not created:", files, err)
+		}
+	})
+}
+
+func TestHashFillFactor(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: Hash, HashFillFactor: 4}, func(db Database) {
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			err := db.Put(NoTransaction, false, &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String(key)},
+				Val: proto.String(key),
+			})
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to create cursor:", err)
+		}
+		defer cur.Close()
+
+		count := 0
+		rec := &TestRecord{}
+		for err = cur.First(rec); err == nil; err = cur.Next(rec) {
+			if rec.GetKey().GetVal() != rec.GetVal() {
+				t.Error("Retrieved record mismatch:", rec)
+			}
+			count++
+		}
+		if !IsNotFound(err) || count != 5 {
+			t.Error("Hash database has wrong number of records:", count, err)
+		}
+
+		count, err = db.Count(NoTransaction)
+		if err != nil || count != 5 {
+			t.Error("Hash database has wrong count:", count, err)
+		}
+	})
+
+	_, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:         true,
+		Type:           BTree,
+		HashFillFactor: 4,
+	})
+	var cerr ConfigError
+	if !errors.As(err, &cerr) {
+		t.Error("Hash fill factor accepted for B-tree:", err)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	err := os.MkdirAll("test.env", 0755)
 	if err == nil {
 		defer os.RemoveAll("test.env")
 	} else {
@@ -63,24 +290,39 @@ func withEnvDb(t *testing.T, dbtype DatabaseType, action func(Environment, Datab
 	env, err := OpenEnvironment("test.env", &EnvironmentConfig{
 		Create:        true,
 		Transactional: true,
+		Private:       true,
+		InMemoryLogs:  true,
 	})
 	if err != nil {
 		t.Fatal("Failed to open environment:", err)
 	}
 
 	var db Database
-	err = env.WithTransaction(nil, func(txn Transaction) error {
-		db, err = OpenDatabase(env, txn, "test.db", &DatabaseConfig{
-			Create: true,
-			Type:   dbtype,
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+			Create:   true,
+			Type:     BTree,
+			Name:     "memory",
+			InMemory: true,
+		})
+		if err != nil {
+			return
+		}
+
+		err = db.Put(txn, false, &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
 		})
-		return err
+		return
 	})
 	if err != nil {
-		t.Fatal("Failed to open database:", err)
+		t.Fatal("Failed to populate in-memory database:", err)
 	}
 
-	action(env, db)
+	files, err := os.ReadDir("test.env")
+	if err != nil || len(files) != 0 {
+		t.Error("In-memory database left files in environment home:", files, err)
+	}
 
 	err = db.Close()
 	if err != nil {
@@ -92,3 +334,113 @@ func withEnvDb(t *testing.T, dbtype DatabaseType, action func(Environment, Datab
 		t.Error("Failed to close environment:", err)
 	}
 }
+
+func TestReadOnly(t *testing.T) {
+	withDb(t, BTree, func(Database) {
+		db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+			ReadOnly: true,
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+
+		err = db.Put(NoTransaction, false, &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		})
+		if err == nil {
+			t.Error("Put into read-only database succeeded")
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Error("Failed to close database:", err)
+		}
+	})
+}
+
+func TestErrorDetail(t *testing.T) {
+	withDb(t, BTree, func(Database) {
+		var buf bytes.Buffer
+
+		db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+			ReadOnly: true,
+			Logger:   slog.New(slog.NewTextHandler(&buf, nil)),
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+
+		err = db.Put(NoTransaction, false, &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		})
+		var operr *OpError
+		if !errors.As(err, &operr) {
+			t.Fatal("Put into read-only database not annotated:", err)
+		}
+		if len(operr.Detail) == 0 || !strings.Contains(operr.Error(), operr.Detail) {
+			t.Error("Error message not attached:", err)
+		}
+		if !strings.Contains(buf.String(), operr.Detail) {
+			t.Error("Error message not logged:", buf.String())
+		}
+
+		err = db.Close()
+		if err != nil {
+			t.Error("Failed to close database:", err)
+		}
+	})
+}
+
+func TestErrorDetailConcurrent(t *testing.T) {
+	withDb(t, BTree, func(Database) {
+		db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+			ReadOnly:    true,
+			Compression: FlateCompression,
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				err := db.Put(NoTransaction, false, rec)
+				var operr *OpError
+				if !errors.As(err, &operr) || len(operr.Detail) == 0 {
+					t.Error("Error message not attached to failing put:", err)
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				err := db.AppendData(NoTransaction, rec)
+				var operr *OpError
+				if !errors.As(err, &operr) || len(operr.Detail) != 0 {
+					t.Error("Unrelated error message attached:", err)
+					return
+				}
+			}
+		}()
+
+		wg.Wait()
+
+		err = db.Close()
+		if err != nil {
+			t.Error("Failed to close database:", err)
+		}
+	})
+}
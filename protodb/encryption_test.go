@@ -0,0 +1,193 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		Create:   true,
+		Type:     BTree,
+		Password: "secret",
+	})
+	if err == nil {
+		defer os.Remove("test.db")
+	} else {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	rec0 := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+		Val: proto.String("world"),
+	}
+
+	err = db.Put(NoTransaction, false, rec0)
+	if err != nil {
+		t.Error("Put failed:", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	db, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", nil)
+	if err == nil {
+		db.Close()
+		t.Fatal("Opened encrypted database without password")
+	}
+
+	db, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{
+		PasswordFunc: func() (string, error) { return "secret", nil },
+	})
+	if err != nil {
+		t.Fatal("Failed to open encrypted database:", err)
+	}
+
+	rec1 := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+	}
+
+	err = db.Get(NoTransaction, false, rec1)
+	if err != nil {
+		t.Error("Get failed:", err)
+	}
+	if *rec0.Val != *rec1.Val {
+		t.Error("Retrieved value mismatch:", rec0, rec1)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+}
+
+// Open an environment with the given configuration and the encrypted
+// database in it.
+func openEncryptedEnvDb(config *EnvironmentConfig) (env Environment, db Database, err error) {
+	env, err = OpenEnvironment("test.env", config)
+	if err != nil {
+		return
+	}
+
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "test.db", &DatabaseConfig{
+			Create:    config.Create,
+			Type:      BTree,
+			Encrypted: true,
+		})
+		return
+	})
+	if err != nil {
+		env.Close()
+	}
+
+	return
+}
+
+func TestEnvironmentEncryption(t *testing.T) {
+	err := os.MkdirAll("test.env", 0755)
+	if err == nil {
+		defer os.RemoveAll("test.env")
+	} else {
+		t.Fatal("Failed to create environment home:", err)
+	}
+
+	err = os.WriteFile("test.key", []byte("secret\n"), 0600)
+	if err == nil {
+		defer os.Remove("test.key")
+	} else {
+		t.Fatal("Failed to write key file:", err)
+	}
+
+	env, db, err := openEncryptedEnvDb(&EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Password:      "secret",
+	})
+	if err != nil {
+		t.Fatal("Failed to open encrypted environment:", err)
+	}
+
+	rec0 := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+		Val: proto.String("world"),
+	}
+
+	err = env.WithTransaction(nil, func(txn Transaction) error {
+		return db.Put(txn, false, rec0)
+	})
+	if err != nil {
+		t.Error("Put failed:", err)
+	}
+
+	db.Close()
+	env.Close()
+
+	env, db, err = openEncryptedEnvDb(&EnvironmentConfig{
+		Transactional: true,
+		Password:      "wrong",
+	})
+	if err == nil {
+		db.Close()
+		env.Close()
+		t.Fatal("Opened encrypted database with wrong password")
+	}
+
+	env, db, err = openEncryptedEnvDb(&EnvironmentConfig{
+		Transactional: true,
+		PasswordFile:  "test.key",
+	})
+	if err != nil {
+		t.Fatal("Failed to open encrypted environment with key file:", err)
+	}
+
+	rec1 := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+	}
+
+	err = db.Get(NoTransaction, false, rec1)
+	if err != nil {
+		t.Error("Get failed:", err)
+	}
+	if *rec0.Val != *rec1.Val {
+		t.Error("Retrieved value mismatch:", rec0, rec1)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
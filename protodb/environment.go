@@ -26,7 +26,11 @@
 package protodb
 
 import (
+	"io/ioutil"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"unsafe"
 )
 
@@ -34,12 +38,82 @@ import (
  #cgo LDFLAGS: -ldb
  #include <stdlib.h>
  #include <db.h>
+ extern int goprotodbIsAlive(DB_ENV *, pid_t, db_threadid_t, u_int32_t);
+ extern void goprotodbThreadID(DB_ENV *, pid_t *, db_threadid_t *);
+ extern void goprotodbErrCall(const DB_ENV *, const char *, const char *);
+ extern void goprotodbMsgCall(const DB_ENV *, const char *);
  static inline int db_env_set_encrypt(DB_ENV *env, const char *passwd, u_int32_t flags) {
  	return env->set_encrypt(env, passwd, flags);
  }
+ static inline int db_env_log_set_config(DB_ENV *env, u_int32_t flags, int onoff) {
+ 	return env->log_set_config(env, flags, onoff);
+ }
+ static inline int db_env_set_lg_bsize(DB_ENV *env, u_int32_t size) {
+ 	return env->set_lg_bsize(env, size);
+ }
+ static inline int db_env_add_data_dir(DB_ENV *env, const char *dir) {
+ 	return env->add_data_dir(env, dir);
+ }
+ static inline int db_env_set_lg_dir(DB_ENV *env, const char *dir) {
+ 	return env->set_lg_dir(env, dir);
+ }
+ static inline int db_env_set_tmp_dir(DB_ENV *env, const char *dir) {
+ 	return env->set_tmp_dir(env, dir);
+ }
+ static inline int db_env_set_metadata_dir(DB_ENV *env, const char *dir) {
+ 	return env->set_metadata_dir(env, dir);
+ }
+ static inline int db_env_get_home(DB_ENV *env, const char **dir) {
+ 	return env->get_home(env, dir);
+ }
+ static inline int db_env_get_data_dirs(DB_ENV *env, const char ***dirs) {
+ 	return env->get_data_dirs(env, dirs);
+ }
+ static inline int db_env_get_lg_dir(DB_ENV *env, const char **dir) {
+ 	return env->get_lg_dir(env, dir);
+ }
+ static inline int db_env_get_tmp_dir(DB_ENV *env, const char **dir) {
+ 	return env->get_tmp_dir(env, dir);
+ }
+ static inline int db_env_get_metadata_dir(DB_ENV *env, const char **dir) {
+ 	return env->get_metadata_dir(env, dir);
+ }
+ static inline int db_env_set_isalive(DB_ENV *env) {
+ 	return env->set_isalive(env, goprotodbIsAlive);
+ }
+ static inline int db_env_set_thread_id(DB_ENV *env) {
+ 	return env->set_thread_id(env, goprotodbThreadID);
+ }
+ static inline int db_env_set_thread_count(DB_ENV *env, u_int32_t count) {
+ 	return env->set_thread_count(env, count);
+ }
+ static inline void db_env_set_errcall(DB_ENV *env) {
+ 	env->set_errcall(env, goprotodbErrCall);
+ }
+ static inline void db_env_set_msgcall(DB_ENV *env) {
+ 	env->set_msgcall(env, goprotodbMsgCall);
+ }
+ static inline void db_env_set_errpfx(DB_ENV *env, const char *pfx) {
+ 	env->set_errpfx(env, pfx);
+ }
+ static inline int db_env_set_verbose(DB_ENV *env, u_int32_t which, int onoff) {
+ 	return env->set_verbose(env, which, onoff);
+ }
+ static inline int db_env_failchk(DB_ENV *env, u_int32_t flags) {
+ 	return env->failchk(env, flags);
+ }
+ static inline int db_env_remove(DB_ENV *env, const char *home, u_int32_t flags) {
+ 	return env->remove(env, home, flags);
+ }
+ static inline int db_env_set_lk_detect(DB_ENV *env, u_int32_t detect) {
+ 	return env->set_lk_detect(env, detect);
+ }
  static inline int db_env_open(DB_ENV *env, const char *home, u_int32_t flags, int mode) {
  	return env->open(env, home, flags, mode);
  }
+ static inline int db_env_get_open_flags(DB_ENV *env, u_int32_t *flags) {
+ 	return env->get_open_flags(env, flags);
+ }
  static inline int db_env_close(DB_ENV *env, u_int32_t flags) {
  	return env->close(env, flags);
  }
@@ -48,15 +122,77 @@ import "C"
 
 // Database environment configuration.
 type EnvironmentConfig struct {
-	Create        bool        // Create the environment, if necessary.
-	Mode          os.FileMode // File creation mode for the environment.
-	Password      string      // Encryption password or an empty string.
-	Recover       bool        // Run recovery on the environment, if necessary.
-	Transactional bool        // Enable transactions in the environment.
-	NoSync        bool        // Do not flush to log when committing.
-	WriteNoSync   bool        // Do not flush log when committing.
+	Create        bool         // Create the environment, if necessary.
+	Mode          os.FileMode  // File creation mode for the environment.
+	Password      string       // Encryption password or an empty string.
+	PasswordFunc  PasswordFunc // Callback providing the encryption password.
+	PasswordFile  string       // File containing the encryption password.
+	Recover       bool         // Run recovery on the environment, if necessary.
+	Transactional bool         // Enable transactions in the environment.
+	Locking       bool         // Enable locking for concurrent access and application locks.
+	NoSync        bool         // Do not flush to log when committing.
+	WriteNoSync   bool         // Do not flush log when committing.
+	Private       bool         // Keep the environment in private memory of this process.
+	InMemoryLogs  bool         // Keep transaction logs in memory only.
+	LogBufferSize uint32       // Size of the log buffer in bytes.
+	DataDirs      []string     // Directories containing database files.
+	LogDir        string       // Directory containing log files.
+	TempDir       string       // Directory for temporary files.
+	MetadataDir   string       // Directory for persistent metadata files.
+	FailCheck     bool         // Check for failed processes when opening the environment.
+	ThreadCount   uint32       // Approximate number of concurrent threads of control.
+	IsAlive       IsAliveFunc  // Callback checking for live processes, ProcessIsAlive if nil.
+	ThreadID      ThreadIDFunc // Callback identifying the current thread of control.
+	Logger        *slog.Logger // Destination of diagnostic messages instead of standard error.
+	ErrorPrefix   string       // Prefix of error messages.
+	Verbose       Verbosity    // Categories of verbose diagnostic messages.
+}
+
+// Categories of verbose diagnostic messages.
+type Verbosity uint32
+
+// Available categories of verbose diagnostic messages.
+const (
+	VerboseRecovery    = Verbosity(1 << iota) // Recovery and failure checking.
+	VerboseDeadlock                           // Deadlock detection.
+	VerboseWaitsFor                           // Waits-for tables of deadlock detection.
+	VerboseReplication                        // Replication.
+)
+
+// Berkeley DB flags corresponding to categories of verbose messages.
+var verbosityFlags = map[Verbosity]C.u_int32_t{
+	VerboseRecovery:    C.DB_VERB_RECOVERY,
+	VerboseDeadlock:    C.DB_VERB_DEADLOCK,
+	VerboseWaitsFor:    C.DB_VERB_WAITSFOR,
+	VerboseReplication: C.DB_VERB_REPLICATION,
+}
+
+// Callback providing an encryption password.
+type PasswordFunc func() (string, error)
+
+// Determine an encryption password from a literal, a callback or a
+// key file, in that order of preference. Trailing line breaks are
+// removed from the contents of a key file. The result is empty if no
+// password was specified.
+func resolvePassword(password string, fun PasswordFunc, file string) (result string, err error) {
+	switch {
+	case len(password) > 0:
+		result = password
+	case fun != nil:
+		result, err = fun()
+	case len(file) > 0:
+		var buf []byte
+		buf, err = ioutil.ReadFile(file)
+		result = strings.TrimRight(string(buf), "\r\n")
+	}
+
+	return
 }
 
+// Number of threads of control assumed for failure checking if none is
+// configured.
+const defaultThreadCount = 64
+
 // Database environment.
 type Environment struct {
 	ptr *C.DB_ENV
@@ -65,13 +201,18 @@ type Environment struct {
 // Special constant to indicate no environment should be used.
 var NoEnvironment = Environment{ptr: nil}
 
-// Open an environment at the given home path.
+// Open an environment at the given home path. The home path may be
+// empty for a private environment with in-memory logs, which does not
+// touch the file system as long as all its databases are kept in
+// memory as well.
 func OpenEnvironment(home string, config *EnvironmentConfig) (env Environment, err error) {
 	err = check(C.db_env_create(&env.ptr, 0))
 	if err == nil {
 		defer func() {
 			if err != nil && env.ptr != nil {
+				release := unregisterCallbacks(env.ptr)
 				C.db_env_close(env.ptr, 0)
+				release()
 				env.ptr = nil
 			}
 		}()
@@ -81,10 +222,15 @@ func OpenEnvironment(home string, config *EnvironmentConfig) (env Environment, e
 
 	var mode C.int = 0
 	var flags C.u_int32_t = C.DB_THREAD
+	var failchk bool
+	var threadcount C.u_int32_t = 0
+	var cbs envCallbacks
 	var chome, cpassword *C.char
 
-	chome = C.CString(home)
-	defer C.free(unsafe.Pointer(chome))
+	if len(home) > 0 {
+		chome = C.CString(home)
+		defer C.free(unsafe.Pointer(chome))
+	}
 
 	if config != nil {
 		if config.Create {
@@ -93,38 +239,347 @@ func OpenEnvironment(home string, config *EnvironmentConfig) (env Environment, e
 		if config.Mode != 0 {
 			mode = C.int(config.Mode)
 		}
-		if len(config.Password) > 0 {
-			cpassword := C.CString(config.Password)
-			C.free(unsafe.Pointer(cpassword))
+		var password string
+		password, err = resolvePassword(config.Password, config.PasswordFunc, config.PasswordFile)
+		if err != nil {
+			return
+		}
+		if len(password) > 0 {
+			cpassword = C.CString(password)
+			defer C.free(unsafe.Pointer(cpassword))
 		}
 		if config.Recover {
 			flags |= C.DB_REGISTER | C.DB_FAILCHK | C.DB_RECOVER
+			failchk = true
+		}
+		if config.FailCheck {
+			flags |= C.DB_FAILCHK
+			failchk = true
+		}
+		if config.ThreadCount != 0 {
+			threadcount = C.u_int32_t(config.ThreadCount)
+		}
+		if config.IsAlive != nil {
+			cbs.isAlive = config.IsAlive
+		}
+		if config.ThreadID != nil {
+			cbs.threadID = config.ThreadID
+		}
+		if config.Logger != nil {
+			cbs.logger = config.Logger
+		}
+		if len(config.ErrorPrefix) > 0 {
+			cbs.errpfx = C.CString(config.ErrorPrefix)
 		}
 		if config.Transactional {
 			flags |= C.DB_INIT_TXN | C.DB_INIT_MPOOL
 		}
+		if config.Locking {
+			flags |= C.DB_INIT_LOCK
+		}
 		if config.NoSync {
 			flags |= C.DB_TXN_NOSYNC
 		}
 		if config.WriteNoSync {
 			flags |= C.DB_TXN_WRITE_NOSYNC
 		}
+		if config.Private {
+			flags |= C.DB_PRIVATE
+		}
+	}
+
+	registerCallbacks(env.ptr, &cbs)
+
+	C.db_env_set_errcall(env.ptr)
+	if cbs.logger != nil {
+		C.db_env_set_msgcall(env.ptr)
+	}
+
+	if cbs.errpfx != nil {
+		C.db_env_set_errpfx(env.ptr, cbs.errpfx)
 	}
 
 	if cpassword != nil {
-		err = check(C.db_env_set_encrypt(env.ptr, cpassword, 0))
+		err = check(C.db_env_set_encrypt(env.ptr, cpassword, C.DB_ENCRYPT_AES))
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil && config.InMemoryLogs {
+		err = check(C.db_env_log_set_config(env.ptr, C.DB_LOG_IN_MEMORY, 1))
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil && config.Locking {
+		err = check(C.db_env_set_lk_detect(env.ptr, C.DB_LOCK_DEFAULT))
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil && config.LogBufferSize != 0 {
+		err = check(C.db_env_set_lg_bsize(env.ptr, C.u_int32_t(config.LogBufferSize)))
+		if err != nil {
+			return
+		}
+	}
+
+	if config != nil {
+		err = env.setDirs(config)
 		if err != nil {
 			return
 		}
 	}
 
+	if config != nil {
+		err = env.setVerbose(config.Verbose)
+		if err != nil {
+			return
+		}
+	}
+
+	if failchk {
+		if threadcount == 0 {
+			threadcount = defaultThreadCount
+		}
+
+		err = check(C.db_env_set_thread_count(env.ptr, threadcount))
+		if err != nil {
+			return
+		}
+
+		err = check(C.db_env_set_isalive(env.ptr))
+		if err != nil {
+			return
+		}
+	}
+
+	if cbs.threadID != nil {
+		err = check(C.db_env_set_thread_id(env.ptr))
+		if err != nil {
+			return
+		}
+	}
+
+	scope := captureErrors(env.ptr)
 	err = check(C.db_env_open(env.ptr, chome, flags, mode))
+	detail := scope.end()
+	if err != nil {
+		err = &OpError{Op: "open environment", File: home, Err: err, Detail: detail}
+	}
 
 	return
 }
 
+// Configure the directories of the environment.
+func (env Environment) setDirs(config *EnvironmentConfig) (err error) {
+	for _, dir := range config.DataDirs {
+		cdir := C.CString(dir)
+		err = check(C.db_env_add_data_dir(env.ptr, cdir))
+		C.free(unsafe.Pointer(cdir))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(config.LogDir) > 0 {
+		cdir := C.CString(config.LogDir)
+		defer C.free(unsafe.Pointer(cdir))
+
+		err = check(C.db_env_set_lg_dir(env.ptr, cdir))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(config.TempDir) > 0 {
+		cdir := C.CString(config.TempDir)
+		defer C.free(unsafe.Pointer(cdir))
+
+		err = check(C.db_env_set_tmp_dir(env.ptr, cdir))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(config.MetadataDir) > 0 {
+		cdir := C.CString(config.MetadataDir)
+		defer C.free(unsafe.Pointer(cdir))
+
+		err = check(C.db_env_set_metadata_dir(env.ptr, cdir))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Enable categories of verbose messages in the environment.
+func (env Environment) setVerbose(verbose Verbosity) (err error) {
+	for verbosity, which := range verbosityFlags {
+		if verbose&verbosity != 0 {
+			err = check(C.db_env_set_verbose(env.ptr, which, 1))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Get the home directory of the environment.
+func (env Environment) Home() (home string, err error) {
+	var chome *C.char
+	err = check(C.db_env_get_home(env.ptr, &chome))
+	if chome != nil {
+		home = C.GoString(chome)
+	}
+	return
+}
+
+// Resolve a directory relative to the home of the environment.
+func (env Environment) resolveDir(cdir *C.char) (dir string, err error) {
+	home, err := env.Home()
+	if err != nil {
+		return
+	}
+
+	if cdir != nil {
+		dir = C.GoString(cdir)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(home, dir)
+	}
+
+	return
+}
+
+// Get the directories containing database files, resolved against the
+// home of the environment. Without explicitly configured directories
+// this is just the home directory.
+func (env Environment) DataDirs() (dirs []string, err error) {
+	var cdirs **C.char
+	err = check(C.db_env_get_data_dirs(env.ptr, &cdirs))
+	if err != nil {
+		return
+	}
+
+	if cdirs != nil {
+		n := 0
+		for unsafe.Slice(cdirs, n+1)[n] != nil {
+			n++
+		}
+
+		for _, cdir := range unsafe.Slice(cdirs, n) {
+			var dir string
+			dir, err = env.resolveDir(cdir)
+			if err != nil {
+				return
+			}
+
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if len(dirs) == 0 {
+		var home string
+		home, err = env.resolveDir(nil)
+		dirs = []string{home}
+	}
+
+	return
+}
+
+// Get the directory containing log files, resolved against the home
+// of the environment.
+func (env Environment) LogDir() (dir string, err error) {
+	var cdir *C.char
+	err = check(C.db_env_get_lg_dir(env.ptr, &cdir))
+	if err == nil {
+		dir, err = env.resolveDir(cdir)
+	}
+	return
+}
+
+// Get the directory for temporary files, resolved against the home of
+// the environment. The result is empty if no directory was configured,
+// in which case a system default is used.
+func (env Environment) TempDir() (dir string, err error) {
+	var cdir *C.char
+	err = check(C.db_env_get_tmp_dir(env.ptr, &cdir))
+	if err == nil && cdir != nil {
+		dir, err = env.resolveDir(cdir)
+	}
+	return
+}
+
+// Get the directory for persistent metadata files, resolved against
+// the home of the environment.
+func (env Environment) MetadataDir() (dir string, err error) {
+	var cdir *C.char
+	err = check(C.db_env_get_metadata_dir(env.ptr, &cdir))
+	if err == nil {
+		dir, err = env.resolveDir(cdir)
+	}
+	return
+}
+
+// Check for threads of control that have exited while holding locks
+// or running transactions and release their resources. This requires
+// failure checking to be enabled and should be called periodically
+// by multi-process applications.
+func (env Environment) FailCheck() (err error) {
+	err = check(C.db_env_failchk(env.ptr, 0))
+	return
+}
+
+// Check whether the environment supports transactions.
+func (env Environment) transactional() (ok bool, err error) {
+	if env.ptr == nil {
+		return
+	}
+
+	var flags C.u_int32_t
+	err = check(C.db_env_get_open_flags(env.ptr, &flags))
+	ok = flags&C.DB_INIT_TXN != 0
+	return
+}
+
 // Close the environment.
 func (env Environment) Close() (err error) {
+	release := unregisterCallbacks(env.ptr)
 	err = check(C.db_env_close(env.ptr, C.u_int32_t(C.DB_FORCESYNC)))
+	release()
+	return
+}
+
+// Remove the environment at the given home path. Unless force is set,
+// removal fails if the environment is still in use by any process.
+func RemoveEnvironment(home string, force bool) (err error) {
+	var ptr *C.DB_ENV
+	err = check(C.db_env_create(&ptr, 0))
+	if err != nil {
+		return
+	}
+
+	var flags C.u_int32_t = 0
+	var chome *C.char
+
+	if len(home) > 0 {
+		chome = C.CString(home)
+		defer C.free(unsafe.Pointer(chome))
+	}
+
+	if force {
+		flags |= C.DB_FORCE
+	}
+
+	err = check(C.db_env_remove(ptr, chome, flags))
+
 	return
 }
@@ -0,0 +1,268 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEnvironmentDirs(t *testing.T) {
+	err := os.MkdirAll("test.env/data", 0755)
+	if err == nil {
+		defer os.RemoveAll("test.env")
+	} else {
+		t.Fatal("Failed to create environment home:", err)
+	}
+
+	err = os.MkdirAll("test.env/logs", 0755)
+	if err != nil {
+		t.Fatal("Failed to create log directory:", err)
+	}
+
+	env, err := OpenEnvironment("test.env", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		DataDirs:      []string{"data"},
+		LogDir:        "logs",
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	dirs, err := env.DataDirs()
+	if err != nil {
+		t.Error("Failed to get data directories:", err)
+	}
+	if len(dirs) != 1 || dirs[0] != filepath.Join("test.env", "data") {
+		t.Error("Data directories mismatch:", dirs)
+	}
+
+	dir, err := env.LogDir()
+	if err != nil {
+		t.Error("Failed to get log directory:", err)
+	}
+	if dir != filepath.Join("test.env", "logs") {
+		t.Error("Log directory mismatch:", dir)
+	}
+
+	var db Database
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "test.db", &DatabaseConfig{
+			Create: true,
+			Type:   BTree,
+		})
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	_, err = os.Stat("test.env/data/test.db")
+	if err != nil {
+		t.Error("Database not created in data directory:", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
+
+func TestFailCheck(t *testing.T) {
+	// Thread identifier reported for a thread of control that exits
+	// while holding a lock.
+	const deadTID = 0xdead
+
+	var current, seen atomic.Uint64
+
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:    true,
+		Private:   true,
+		Locking:   true,
+		FailCheck: true,
+		IsAlive: func(pid int, tid uint64, processOnly bool) bool {
+			if tid == deadTID {
+				seen.Store(tid)
+				return processOnly
+			}
+			return true
+		},
+		ThreadID: func() (pid int, tid uint64) {
+			pid, tid = currentThreadID()
+			if v := current.Load(); v != 0 {
+				tid = v
+			}
+			return
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+	defer env.Close()
+
+	current.Store(deadTID)
+	a, err := env.NewLocker()
+	if err == nil {
+		_, err = a.Lock("leader", LockRead, false)
+	}
+	current.Store(0)
+	if err != nil {
+		t.Fatal("Lock failed:", err)
+	}
+
+	b, err := env.NewLocker()
+	if err != nil {
+		t.Fatal("Failed to allocate locker:", err)
+	}
+	defer b.Close()
+
+	_, err = b.Lock("leader", LockWrite, false)
+	if !errors.Is(err, ErrLockNotGranted) {
+		t.Fatal("Conflicting lock granted:", err)
+	}
+
+	err = env.FailCheck()
+	if err != nil {
+		t.Fatal("Failure check failed:", err)
+	}
+	if seen.Load() != deadTID {
+		t.Error("Thread identification callback not consulted by failure check")
+	}
+
+	lock, err := b.Lock("leader", LockWrite, false)
+	if err != nil {
+		t.Fatal("Lock of dead thread not released:", err)
+	}
+
+	err = b.Unlock(lock)
+	if err != nil {
+		t.Error("Unlock failed:", err)
+	}
+}
+
+func TestCloseThreadID(t *testing.T) {
+	calls := 0
+
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Private:       true,
+		InMemoryLogs:  true,
+		FailCheck:     true,
+		ThreadID: func() (pid int, tid uint64) {
+			calls++
+			return currentThreadID()
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+	if calls == 0 {
+		t.Error("Thread identification callback not called")
+	}
+
+	if _, ok := callbacks[env.ptr]; ok {
+		t.Error("Callbacks of closed environment still registered")
+	}
+}
+
+func TestRemoveEnvironment(t *testing.T) {
+	err := os.Mkdir("test.env", 0755)
+	if err == nil {
+		defer os.RemoveAll("test.env")
+	} else {
+		t.Fatal("Failed to create environment home:", err)
+	}
+
+	env, err := OpenEnvironment("test.env", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+
+	err = RemoveEnvironment("test.env", false)
+	if err != nil {
+		t.Error("Failed to remove environment:", err)
+	}
+
+	regions, _ := filepath.Glob("test.env/__db.*")
+	if len(regions) > 0 {
+		t.Error("Environment regions left behind:", regions)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Private:       true,
+		InMemoryLogs:  true,
+		Logger:        slog.New(slog.NewTextHandler(&buf, nil)),
+		ErrorPrefix:   "test",
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	err = env.FailCheck()
+	if err == nil {
+		t.Error("Failure check without liveness callback succeeded")
+	}
+	if !strings.Contains(buf.String(), "prefix=test") {
+		t.Error("Error message not logged:", buf.String())
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
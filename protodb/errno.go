@@ -25,6 +25,11 @@
 
 package protodb
 
+import (
+	"errors"
+	"fmt"
+)
+
 /*
  #cgo LDFLAGS: -ldb
  #include <errno.h>
@@ -69,3 +74,59 @@ func check(rc C.int) (err error) {
 	}
 	return
 }
+
+// Error annotated with the operation it occurred in.
+type OpError struct {
+	Op       string // Name of the operation.
+	File     string // File of the database, if any.
+	Database string // Name of the database inside the file, if any.
+	Key      string // Key of the record or object of the lock involved, if any.
+	TxnID    uint32 // Identifier of the transaction, if any.
+	Err      error  // Underlying error.
+	Detail   string // Last error message reported by Berkeley DB, if any.
+}
+
+// Describe the error along with its context.
+func (err *OpError) Error() string {
+	msg := "protodb: " + err.Op
+	if len(err.File) > 0 {
+		msg += " " + err.File
+	}
+	if len(err.Database) > 0 {
+		msg += " (" + err.Database + ")"
+	}
+	if len(err.Key) > 0 {
+		msg += " key {" + err.Key + "}"
+	}
+	if err.TxnID != 0 {
+		msg += fmt.Sprintf(" txn %#x", err.TxnID)
+	}
+
+	msg += ": " + err.Err.Error()
+	if len(err.Detail) > 0 {
+		msg += " (" + err.Detail + ")"
+	}
+
+	return msg
+}
+
+// Get the underlying error.
+func (err *OpError) Unwrap() error {
+	return err.Err
+}
+
+// Check whether an error indicates a missing or deleted record.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrKeyEmpty)
+}
+
+// Check whether an error indicates an existing record.
+func IsKeyExists(err error) bool {
+	return errors.Is(err, ErrKeyExists)
+}
+
+// Check whether an error indicates a lock conflict, in which case the
+// operation may succeed if the enclosing transaction is retried.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrLockDeadlock) || errors.Is(err, ErrLockNotGranted) || errors.Is(err, ErrAgain)
+}
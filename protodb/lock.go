@@ -0,0 +1,408 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+/*
+ #include <stdlib.h>
+ #include <db.h>
+ static inline int db_env_lock_id(DB_ENV *env, u_int32_t *id) {
+ 	return env->lock_id(env, id);
+ }
+ static inline int db_env_lock_id_free(DB_ENV *env, u_int32_t id) {
+ 	return env->lock_id_free(env, id);
+ }
+ static inline int db_env_lock_get(DB_ENV *env, u_int32_t locker, u_int32_t flags, DBT *obj, db_lockmode_t mode, DB_LOCK *lock) {
+ 	return env->lock_get(env, locker, flags, obj, mode, lock);
+ }
+ static inline int db_env_lock_put(DB_ENV *env, DB_LOCK *lock) {
+ 	return env->lock_put(env, lock);
+ }
+ static inline int db_env_lock_vec(DB_ENV *env, u_int32_t locker, u_int32_t flags, DB_LOCKREQ *list, int n, int *failed) {
+ 	DB_LOCKREQ *elist = NULL;
+ 	int rc = env->lock_vec(env, locker, flags, list, n, &elist);
+ 	*failed = elist != NULL ? (int)(elist - list) : -1;
+ 	return rc;
+ }
+ static inline int db_env_lock_detect(DB_ENV *env, u_int32_t atype) {
+ 	return env->lock_detect(env, 0, atype, NULL);
+ }
+*/
+import "C"
+
+// Mode of a lock.
+type LockMode int
+
+// Available lock modes. Intent locks announce the intention to lock
+// contained objects, for example records of a locked table.
+const (
+	LockRead            = LockMode(C.DB_LOCK_READ)
+	LockWrite           = LockMode(C.DB_LOCK_WRITE)
+	LockIntentRead      = LockMode(C.DB_LOCK_IREAD)
+	LockIntentWrite     = LockMode(C.DB_LOCK_IWRITE)
+	LockIntentReadWrite = LockMode(C.DB_LOCK_IWR)
+)
+
+// Operation of a lock request.
+type LockOp int
+
+// Available lock operations.
+const (
+	LockGet        = LockOp(C.DB_LOCK_GET)         // Acquire a lock on an object.
+	LockGetTimeout = LockOp(C.DB_LOCK_GET_TIMEOUT) // Acquire a lock on an object with a timeout.
+	LockPut        = LockOp(C.DB_LOCK_PUT)         // Release a lock.
+	LockPutAll     = LockOp(C.DB_LOCK_PUT_ALL)     // Release all locks of the locker.
+	LockPutObject  = LockOp(C.DB_LOCK_PUT_OBJ)     // Release all locks on an object.
+)
+
+// Lock held on an object.
+type Lock struct {
+	lock C.DB_LOCK
+}
+
+// Request in a vector of lock operations.
+type LockRequest struct {
+	Op      LockOp        // Operation to perform.
+	Object  string        // Object to lock or release.
+	Mode    LockMode      // Mode of the lock to acquire.
+	Timeout time.Duration // Time to wait for the lock to be granted.
+	Lock    *Lock         // Lock to release or acquired lock.
+}
+
+// Identity owning locks in an environment, shared by all processes
+// using the environment. The lock subsystem of the environment must
+// be enabled.
+type Locker struct {
+	env Environment
+	id  C.u_int32_t
+}
+
+// Allocate a new locker in the environment.
+func (env Environment) NewLocker() (locker Locker, err error) {
+	locker.env = env
+	defer locker.annotate("new locker", nil, &err)()
+
+	err = check(C.db_env_lock_id(env.ptr, &locker.id))
+	return
+}
+
+// Get the identifier of the locker.
+func (locker Locker) ID() uint32 {
+	return uint32(locker.id)
+}
+
+// Free the locker. It must not hold any locks.
+func (locker Locker) Close() (err error) {
+	defer locker.annotate("free locker", nil, &err)()
+
+	err = check(C.db_env_lock_id_free(locker.env.ptr, locker.id))
+	return
+}
+
+// Collect the error messages of a locker operation and return a
+// function wrapping the error, if any, in an OpError with the object
+// involved.
+func (locker Locker) annotate(op string, object *string, err *error) func() {
+	scope := captureErrors(locker.env.ptr)
+
+	return func() {
+		detail := scope.end()
+		if *err == nil {
+			return
+		}
+
+		operr := &OpError{Op: op, Err: *err, Detail: detail}
+		if object != nil {
+			operr.Key = *object
+		}
+
+		*err = operr
+	}
+}
+
+// Acquire a lock on an object. If wait is false, the operation fails
+// with ErrLockNotGranted instead of waiting for conflicting locks to
+// be released.
+func (locker Locker) Lock(object string, mode LockMode, wait bool) (lock *Lock, err error) {
+	defer locker.annotate("lock", &object, &err)()
+
+	var flags C.u_int32_t = 0
+	if !wait {
+		flags |= C.DB_LOCK_NOWAIT
+	}
+
+	var obj C.DBT
+	obj.data = C.CBytes([]byte(object))
+	obj.size = C.u_int32_t(len(object))
+	defer C.free(obj.data)
+
+	lock = &Lock{}
+	err = check(C.db_env_lock_get(locker.env.ptr, locker.id, flags, &obj, C.db_lockmode_t(mode), &lock.lock))
+	if err != nil {
+		lock = nil
+	}
+
+	return
+}
+
+// Acquire a lock on an object, waiting at most for the given time for
+// conflicting locks to be released. The operation fails with
+// ErrLockNotGranted if the timeout expires.
+func (locker Locker) LockTimeout(object string, mode LockMode, timeout time.Duration) (lock *Lock, err error) {
+	defer locker.annotate("lock", &object, &err)()
+
+	req := []LockRequest{{Op: LockGetTimeout, Object: object, Mode: mode, Timeout: timeout}}
+
+	_, err = locker.vec(req, true)
+	if err == nil {
+		lock = req[0].Lock
+	}
+
+	return
+}
+
+// Bounds of the interval between checks for expired lock requests.
+const (
+	minExpireInterval = time.Millisecond
+	maxExpireInterval = 100 * time.Millisecond
+)
+
+// Goroutine rejecting the expired lock requests of an environment,
+// shared by all timed requests waiting in it. Berkeley DB only checks
+// timeouts when a request first blocks or when the deadlock detector
+// runs, so a request blocked by a holder that never releases its lock
+// would otherwise wait forever.
+type lockExpirer struct {
+	timeouts map[time.Duration]int // Timeouts of the waiting requests.
+	wake     chan struct{}         // Signalled when a shorter timeout arrives.
+	quit     chan struct{}         // Closed when no requests are left.
+	finished chan struct{}         // Closed when the goroutine has exited.
+}
+
+var (
+	expirers     = make(map[*C.DB_ENV]*lockExpirer)
+	expirersLock sync.Mutex
+)
+
+// Get the shortest timeout of the waiting requests, or zero if there
+// are none.
+func (exp *lockExpirer) shortest() (timeout time.Duration) {
+	for t := range exp.timeouts {
+		if timeout == 0 || t < timeout {
+			timeout = t
+		}
+	}
+	return
+}
+
+// Register a lock request waiting with the given timeout, starting the
+// expirer of the environment if necessary. The returned function
+// deregisters the request and stops the expirer once no requests are
+// left.
+func (env Environment) expireLocks(timeout time.Duration) (done func()) {
+	expirersLock.Lock()
+	defer expirersLock.Unlock()
+
+	exp := expirers[env.ptr]
+	if exp == nil {
+		exp = &lockExpirer{
+			timeouts: make(map[time.Duration]int),
+			wake:     make(chan struct{}, 1),
+			quit:     make(chan struct{}),
+			finished: make(chan struct{}),
+		}
+		expirers[env.ptr] = exp
+		go env.runExpirer(exp)
+	} else if timeout < exp.shortest() {
+		select {
+		case exp.wake <- struct{}{}:
+		default:
+		}
+	}
+	exp.timeouts[timeout]++
+
+	done = func() {
+		expirersLock.Lock()
+		exp.timeouts[timeout]--
+		if exp.timeouts[timeout] == 0 {
+			delete(exp.timeouts, timeout)
+		}
+		last := len(exp.timeouts) == 0
+		if last {
+			delete(expirers, env.ptr)
+			close(exp.quit)
+		}
+		expirersLock.Unlock()
+
+		if last {
+			<-exp.finished
+		}
+	}
+	return
+}
+
+// Periodically reject expired lock requests, checking at a quarter of
+// the shortest waiting timeout, until the expirer is stopped.
+func (env Environment) runExpirer(exp *lockExpirer) {
+	defer close(exp.finished)
+
+	for {
+		expirersLock.Lock()
+		interval := exp.shortest() / 4
+		expirersLock.Unlock()
+
+		if interval < minExpireInterval {
+			interval = minExpireInterval
+		} else if interval > maxExpireInterval {
+			interval = maxExpireInterval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-exp.quit:
+			timer.Stop()
+			return
+		case <-exp.wake:
+			timer.Stop()
+		case <-timer.C:
+			C.db_env_lock_detect(env.ptr, C.DB_LOCK_EXPIRE)
+		}
+	}
+}
+
+// Get the shortest timeout of the timed acquisitions in a vector of
+// lock requests, or zero if there are none.
+func minTimeout(reqs []LockRequest) (timeout time.Duration) {
+	for _, req := range reqs {
+		if req.Op == LockGetTimeout && req.Timeout > 0 && (timeout == 0 || req.Timeout < timeout) {
+			timeout = req.Timeout
+		}
+	}
+	return
+}
+
+// Release a lock.
+func (locker Locker) Unlock(lock *Lock) (err error) {
+	defer locker.annotate("unlock", nil, &err)()
+
+	if lock == nil {
+		err = ErrInvalid
+		return
+	}
+
+	err = check(C.db_env_lock_put(locker.env.ptr, &lock.lock))
+	return
+}
+
+// Perform a vector of lock requests atomically with respect to other
+// lockers. Acquired locks are stored in the requests. If wait is
+// false, acquisitions fail instead of waiting for conflicting locks.
+// If a request fails, the preceding ones have been performed and the
+// index of the failed one is returned; otherwise the index is -1.
+// Requests to release a lock must carry the lock, otherwise the
+// operation fails with ErrInvalid before any request is performed.
+func (locker Locker) Vec(reqs []LockRequest, wait bool) (failed int, err error) {
+	var object string
+	defer locker.annotate("lock vec", &object, &err)()
+
+	failed, err = locker.vec(reqs, wait)
+	if failed >= 0 {
+		object = reqs[failed].Object
+	}
+
+	return
+}
+
+// Perform a vector of lock requests without annotating errors.
+func (locker Locker) vec(reqs []LockRequest, wait bool) (failed int, err error) {
+	failed = -1
+	if len(reqs) == 0 {
+		return
+	}
+
+	for _, req := range reqs {
+		if req.Op == LockPut && req.Lock == nil {
+			err = ErrInvalid
+			return
+		}
+	}
+
+	if timeout := minTimeout(reqs); wait && timeout > 0 {
+		defer locker.env.expireLocks(timeout)()
+	}
+
+	var flags C.u_int32_t = 0
+	if !wait {
+		flags |= C.DB_LOCK_NOWAIT
+	}
+
+	clist := (*C.DB_LOCKREQ)(C.calloc(C.size_t(len(reqs)), C.size_t(unsafe.Sizeof(C.DB_LOCKREQ{}))))
+	defer C.free(unsafe.Pointer(clist))
+	cobjs := (*C.DBT)(C.calloc(C.size_t(len(reqs)), C.size_t(unsafe.Sizeof(C.DBT{}))))
+	defer C.free(unsafe.Pointer(cobjs))
+
+	list := unsafe.Slice(clist, len(reqs))
+	objs := unsafe.Slice(cobjs, len(reqs))
+
+	for i, req := range reqs {
+		list[i].op = C.db_lockop_t(req.Op)
+		list[i].mode = C.db_lockmode_t(req.Mode)
+		list[i].timeout = C.db_timeout_t(req.Timeout / time.Microsecond)
+
+		switch req.Op {
+		case LockGet, LockGetTimeout, LockPutObject:
+			objs[i].data = C.CBytes([]byte(req.Object))
+			objs[i].size = C.u_int32_t(len(req.Object))
+			defer C.free(objs[i].data)
+			list[i].obj = &objs[i]
+		case LockPut:
+			list[i].lock = req.Lock.lock
+		}
+	}
+
+	var cfailed C.int
+	err = check(C.db_env_lock_vec(locker.env.ptr, locker.id, flags, clist, C.int(len(reqs)), &cfailed))
+	if err != nil {
+		failed = int(cfailed)
+	}
+
+	for i := range reqs {
+		if err != nil && i >= failed {
+			break
+		}
+		switch reqs[i].Op {
+		case LockGet, LockGetTimeout:
+			reqs[i].Lock = &Lock{lock: list[i].lock}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,236 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run an action with two lockers in a private environment.
+func withLockers(t *testing.T, action func(a, b Locker)) {
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:  true,
+		Private: true,
+		Locking: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	a, err := env.NewLocker()
+	if err != nil {
+		t.Fatal("Failed to allocate locker:", err)
+	}
+	b, err := env.NewLocker()
+	if err != nil {
+		t.Fatal("Failed to allocate locker:", err)
+	}
+
+	action(a, b)
+
+	for _, locker := range []Locker{a, b} {
+		err = locker.Close()
+		if err != nil {
+			t.Error("Failed to free locker:", err)
+		}
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	withLockers(t, func(a, b Locker) {
+		lock, err := a.Lock("leader", LockWrite, false)
+		if err != nil {
+			t.Fatal("Lock failed:", err)
+		}
+
+		_, err = b.Lock("leader", LockRead, false)
+		if !errors.Is(err, ErrLockNotGranted) {
+			t.Error("Conflicting lock granted:", err)
+		}
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			a.Unlock(lock)
+		}()
+
+		other, err := b.LockTimeout("leader", LockWrite, time.Second)
+		if err != nil {
+			t.Fatal("Lock with timeout failed:", err)
+		}
+
+		err = b.Unlock(other)
+		if err != nil {
+			t.Error("Unlock failed:", err)
+		}
+	})
+}
+
+func TestLockTimeout(t *testing.T) {
+	withLockers(t, func(a, b Locker) {
+		lock, err := a.Lock("leader", LockWrite, false)
+		if err != nil {
+			t.Fatal("Lock failed:", err)
+		}
+
+		timeout := 50 * time.Millisecond
+		start := time.Now()
+		_, err = b.LockTimeout("leader", LockWrite, timeout)
+		elapsed := time.Since(start)
+		if !errors.Is(err, ErrLockNotGranted) {
+			t.Error("Lock with expired timeout granted:", err)
+		}
+		if elapsed < timeout || elapsed > 10*timeout {
+			t.Error("Lock with timeout did not expire in time:", elapsed)
+		}
+
+		err = a.Unlock(lock)
+		if err != nil {
+			t.Error("Unlock failed:", err)
+		}
+	})
+}
+
+func TestSharedLock(t *testing.T) {
+	withLockers(t, func(a, b Locker) {
+		ra, err := a.Lock("table", LockRead, false)
+		if err != nil {
+			t.Fatal("Lock failed:", err)
+		}
+		rb, err := b.Lock("table", LockIntentRead, false)
+		if err != nil {
+			t.Fatal("Compatible lock not granted:", err)
+		}
+
+		_, err = b.Lock("table", LockIntentWrite, false)
+		if !errors.Is(err, ErrLockNotGranted) {
+			t.Error("Conflicting intent lock granted:", err)
+		}
+
+		for locker, lock := range map[Locker]*Lock{a: ra, b: rb} {
+			err = locker.Unlock(lock)
+			if err != nil {
+				t.Error("Unlock failed:", err)
+			}
+		}
+	})
+}
+
+func TestLockVec(t *testing.T) {
+	withLockers(t, func(a, b Locker) {
+		reqs := []LockRequest{
+			{Op: LockGet, Object: "x", Mode: LockWrite},
+			{Op: LockGet, Object: "y", Mode: LockWrite},
+		}
+
+		failed, err := a.Vec(reqs, false)
+		if err != nil || failed != -1 {
+			t.Fatal("Lock vector failed:", failed, err)
+		}
+		if reqs[0].Lock == nil || reqs[1].Lock == nil {
+			t.Fatal("Lock vector did not return locks:", reqs)
+		}
+
+		failed, err = b.Vec([]LockRequest{
+			{Op: LockGet, Object: "z", Mode: LockWrite},
+			{Op: LockGet, Object: "y", Mode: LockWrite},
+		}, false)
+		if !errors.Is(err, ErrLockNotGranted) || failed != 1 {
+			t.Error("Conflicting lock vector succeeded:", failed, err)
+		}
+		var operr *OpError
+		if !errors.As(err, &operr) || operr.Op != "lock vec" || operr.Key != "y" {
+			t.Error("Lock vector error lacks context:", err)
+		}
+
+		_, err = a.Vec([]LockRequest{{Op: LockPut}}, false)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Releasing nil lock not rejected:", err)
+		}
+
+		_, err = a.Vec([]LockRequest{{Op: LockPut, Lock: reqs[0].Lock}, {Op: LockPutAll}}, false)
+		if err != nil {
+			t.Error("Releasing locks failed:", err)
+		}
+
+		_, err = b.Vec([]LockRequest{{Op: LockGet, Object: "y", Mode: LockWrite}, {Op: LockPutAll}}, false)
+		if err != nil {
+			t.Error("Lock vector after release failed:", err)
+		}
+	})
+}
+
+func TestLockTimeoutShared(t *testing.T) {
+	withLockers(t, func(a, b Locker) {
+		lock, err := a.Lock("leader", LockWrite, false)
+		if err != nil {
+			t.Fatal("Lock failed:", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, err := b.LockTimeout("leader", LockWrite, 50*time.Millisecond)
+				if !errors.Is(err, ErrLockNotGranted) {
+					t.Error("Lock with expired timeout granted:", err)
+				}
+			}()
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		expirersLock.Lock()
+		n := len(expirers)
+		expirersLock.Unlock()
+		if n != 1 {
+			t.Error("Lock expirer not shared:", n)
+		}
+
+		wg.Wait()
+
+		expirersLock.Lock()
+		n = len(expirers)
+		expirersLock.Unlock()
+		if n != 0 {
+			t.Error("Lock expirer not stopped:", n)
+		}
+
+		err = a.Unlock(lock)
+		if err != nil {
+			t.Error("Unlock failed:", err)
+		}
+	})
+}
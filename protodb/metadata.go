@@ -0,0 +1,123 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Flags indicating the fields present in a metadata header.
+const (
+	metaExpires = 1 << iota
+	metaVersion
+	metaDeleted
+)
+
+// Maximum length of a metadata header.
+const maxMetadataSize = 2 + 2*binary.MaxVarintLen64
+
+// Metadata stored in front of the data of a record, in a header
+// starting with metadataMarker; see reservedPrefix.
+type recordMeta struct {
+	expires int64  // Expiry time in Unix nanoseconds, zero if never.
+	version uint64 // Version counter, zero if unversioned.
+	deleted bool   // Whether this is the tombstone of a deleted record.
+}
+
+// Check whether a record with this metadata has expired. Tombstones
+// count as expired, so they are hidden like expired records.
+func (meta recordMeta) expired() bool {
+	return meta.deleted || meta.expires != 0 && meta.expires <= time.Now().UnixNano()
+}
+
+// Prefix stored data with a metadata header, unless the metadata is
+// empty and the header is not forced. Data produced by a transformer
+// may start with any byte, so it must always be prefixed with a header
+// to be told apart from one.
+func (meta recordMeta) prepend(buf []byte, force bool) (out []byte) {
+	var flags byte
+	if meta.expires != 0 {
+		flags |= metaExpires
+	}
+	if meta.version != 0 {
+		flags |= metaVersion
+	}
+	if meta.deleted {
+		flags |= metaDeleted
+	}
+	if flags == 0 && !force {
+		return buf
+	}
+
+	out = make([]byte, 2, maxMetadataSize+len(buf))
+	out[0] = metadataMarker
+	out[1] = flags
+
+	var field [binary.MaxVarintLen64]byte
+	if flags&metaExpires != 0 {
+		out = append(out, field[:binary.PutVarint(field[:], meta.expires)]...)
+	}
+	if flags&metaVersion != 0 {
+		out = append(out, field[:binary.PutUvarint(field[:], meta.version)]...)
+	}
+
+	out = append(out, buf...)
+	return
+}
+
+// Split the metadata header, if any, from stored data.
+func splitMeta(buf []byte) (meta recordMeta, out []byte, err error) {
+	if len(buf) < 2 || buf[0] != metadataMarker {
+		out = buf
+		return
+	}
+
+	flags := buf[1]
+	out = buf[2:]
+	meta.deleted = flags&metaDeleted != 0
+
+	if flags&metaExpires != 0 {
+		n := 0
+		meta.expires, n = binary.Varint(out)
+		if n <= 0 {
+			err = ErrInvalid
+			return
+		}
+		out = out[n:]
+	}
+	if flags&metaVersion != 0 {
+		n := 0
+		meta.version, n = binary.Uvarint(out)
+		if n <= 0 {
+			err = ErrInvalid
+			return
+		}
+		out = out[n:]
+	}
+
+	return
+}
@@ -30,5 +30,7 @@
 // that holds the key for the record; this field can be of any
 // protobuf serializable message type or, if you plan to store the
 // records in a numbered or queue database, it should hold an unsigned
-// 32-bit integer.
+// 32-bit integer. Records stored in a heap database should have an
+// unsigned 64-bit integer key, which holds the page number of the
+// record ID in its upper bits and the index in its lower 16 bits.
 package protodb
@@ -0,0 +1,205 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursorKeys(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("car")},
+			Val: proto.String("foo"),
+		}
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("cdr")},
+			Val: proto.String("bar"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0, rec1)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to create cursor:", err)
+		}
+
+		rec := &TestRecord{}
+
+		err = cur.FirstKey(rec)
+		if err != nil {
+			t.Error("Cursor key walk failed:", err)
+		}
+		if *rec0.Key.Val != *rec.Key.Val {
+			t.Error("Retrieved key mismatch:", rec0, rec)
+		}
+		if rec.Val != nil {
+			t.Error("Value retrieved by key walk:", rec)
+		}
+
+		err = cur.NextKey(rec)
+		if err != nil {
+			t.Error("Cursor key walk failed:", err)
+		}
+		if *rec1.Key.Val != *rec.Key.Val {
+			t.Error("Retrieved key mismatch:", rec1, rec)
+		}
+
+		err = cur.NextKey(rec)
+		if !errors.Is(err, ErrNotFound) {
+			t.Error("Illegal cursor key walk succeeded:", rec, err)
+		}
+
+		err = cur.Close()
+		if err != nil {
+			t.Error("Cursor close failed:", err)
+		}
+	})
+}
+
+func TestPartial(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, rec0, 2, 3)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if string(buf) != "wor" {
+			t.Error("Retrieved partial data mismatch:", buf)
+		}
+
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("there"),
+		}
+
+		err = db.AppendData(NoTransaction, rec1)
+		if err != nil {
+			t.Error("Append failed:", err)
+		}
+
+		buf, err = db.GetPartial(NoTransaction, rec0, 0, 1024)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if len(buf) != 14 {
+			t.Error("Appended data size mismatch:", buf)
+		}
+
+		rec2 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+		}
+
+		err = db.Get(NoTransaction, false, rec2)
+		if err != nil {
+			t.Error("Get failed:", err)
+		}
+		if *rec1.Val != *rec2.Val {
+			t.Error("Retrieved value mismatch:", rec1, rec2)
+		}
+	})
+}
+
+func TestPartialMetadata(t *testing.T) {
+	rec := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+		Val: proto.String("world"),
+	}
+
+	for _, config := range []*DatabaseConfig{
+		{Create: true, Type: BTree, Versioned: true},
+		{Create: true, Type: BTree, TTL: time.Hour},
+	} {
+		withDbConfig(t, config, func(db Database) {
+			err := db.Put(NoTransaction, false, rec)
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+
+			err = db.AppendData(NoTransaction, &TestRecord{Key: rec.Key, Val: proto.String("there")})
+			if !errors.Is(err, ErrInvalid) {
+				t.Error("Append bypassing metadata accepted:", config, err)
+			}
+
+			err = db.AppendData(NoTransaction, &TestRecord{Key: &TestRecord_Key{Val: proto.String("new")}, Val: proto.String("there")})
+			if !errors.Is(err, ErrInvalid) {
+				t.Error("Append creating record without metadata accepted:", config, err)
+			}
+
+			err = db.PutPartial(NoTransaction, rec, 0, 0, []byte{0x12, 0x00})
+			if !errors.Is(err, ErrInvalid) {
+				t.Error("Partial put bypassing metadata accepted:", config, err)
+			}
+		})
+	}
+
+	withDb(t, BTree, func(db Database) {
+		err := db.PutWithTTL(NoTransaction, false, time.Hour, rec)
+		if err != nil {
+			t.Fatal("Put with TTL failed:", err)
+		}
+
+		err = db.AppendData(NoTransaction, &TestRecord{Key: rec.Key, Val: proto.String("there")})
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Append to record with TTL accepted:", err)
+		}
+
+		got := &TestRecord{Key: rec.Key}
+		err = db.Get(NoTransaction, false, got)
+		if err != nil || got.GetVal() != "world" {
+			t.Error("Record with TTL changed:", got, err)
+		}
+	})
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Versioned: true}, func(db Database) {
+		err := db.Put(NoTransaction, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		db.AppendData(NoTransaction, &TestRecord{Key: rec.Key, Val: proto.String("there")})
+
+		err = db.PutIfVersion(NoTransaction, rec, 1)
+		if err != nil {
+			t.Error("Versioned put after rejected append failed:", err)
+		}
+	})
+}
@@ -27,6 +27,7 @@ package protodb
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"errors"
 	"testing"
 )
 
@@ -55,7 +56,7 @@ func TestPutGetDel(t *testing.T) {
 
 			return
 		})
-		if err != ErrKeyEmpty {
+		if !errors.Is(err, ErrKeyEmpty) {
 			t.Error("Illegal del+get succeeded:", rec1, err)
 		}
 
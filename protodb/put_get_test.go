@@ -27,6 +27,7 @@ package protodb
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"errors"
 	"testing"
 )
 
@@ -62,7 +63,7 @@ func TestPutGet(t *testing.T) {
 		}
 
 		err = db.Get(NoTransaction, false, rec1)
-		if err != ErrNotFound {
+		if !errors.Is(err, ErrNotFound) {
 			t.Error("Illegal get succeeded:", rec1, err)
 		}
 
@@ -96,3 +97,141 @@ func TestPutGetNumbered(t *testing.T) {
 		return
 	})
 }
+
+func TestExistsCount(t *testing.T) {
+	withDb(t, Numbered, func(db Database) {
+		rec0 := &NumberedTestRecord{
+			Val: proto.String("hello"),
+		}
+		rec1 := &NumberedTestRecord{
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, true, rec0, rec1)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		ok, err := db.Exists(NoTransaction, rec1)
+		if err != nil {
+			t.Error("Exists failed:", err)
+		}
+		if !ok {
+			t.Error("Existing record not found:", rec1)
+		}
+
+		ok, err = db.Exists(NoTransaction, &NumberedTestRecord{Key: proto.Uint32(42)})
+		if err != nil {
+			t.Error("Exists failed:", err)
+		}
+		if ok {
+			t.Error("Missing record found")
+		}
+
+		count, err := db.Count(NoTransaction)
+		if err != nil {
+			t.Error("Count failed:", err)
+		}
+		if count != 2 {
+			t.Error("Record count mismatch:", count)
+		}
+	})
+}
+
+func TestKeyRange(t *testing.T) {
+	for _, config := range []*DatabaseConfig{
+		{Create: true, Type: BTree},
+		{Create: true, Type: BTree, RecordNumbers: true},
+	} {
+		withDbConfig(t, config, func(db Database) {
+			rec0 := &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("a")},
+				Val: proto.String("foo"),
+			}
+			rec1 := &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("b")},
+				Val: proto.String("bar"),
+			}
+			rec2 := &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("c")},
+				Val: proto.String("baz"),
+			}
+
+			err := db.Put(NoTransaction, false, rec0, rec1, rec2)
+			if err != nil {
+				t.Error("Put failed:", err)
+			}
+
+			kr, err := db.KeyRange(NoTransaction, rec1)
+			if err != nil {
+				t.Error("Key range failed:", err)
+			}
+			if sum := kr.Less + kr.Equal + kr.Greater; sum < 0.99 || sum > 1.01 {
+				t.Error("Key range proportions do not add up:", kr)
+			}
+			if kr.Equal == 0 {
+				t.Error("Existing key not found in key range:", kr)
+			}
+
+			count, err := db.EstimateCount(NoTransaction, rec0, rec2)
+			if err != nil {
+				t.Error("Count estimation failed:", err)
+			}
+			if count != 2 {
+				t.Error("Count estimate mismatch:", config, count)
+			}
+		})
+	}
+}
+
+func TestPutGetHeap(t *testing.T) {
+	withDb(t, Heap, func(db Database) {
+		rec0 := &HeapTestRecord{
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, true, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+		if rec0.Key == nil {
+			t.Fatal("No record ID assigned:", rec0)
+		}
+
+		rec1 := &HeapTestRecord{
+			Key: rec0.Key,
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get failed:", err)
+		}
+		if *rec0.Val != *rec1.Val {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+	})
+}
+
+func TestOpError(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("missing")},
+		}
+
+		err := db.Get(NoTransaction, false, rec)
+		if !IsNotFound(err) {
+			t.Fatal("Illegal get succeeded:", rec, err)
+		}
+
+		operr, ok := err.(*OpError)
+		if !ok {
+			t.Fatal("Error lacks context:", err)
+		}
+		if operr.Op != "get" || operr.File != "test.db" || operr.Key != `val:"missing"` {
+			t.Error("Error context mismatch:", operr)
+		}
+		if IsRetryable(err) {
+			t.Error("Missing record considered retryable:", err)
+		}
+	})
+}
@@ -77,5 +77,29 @@ func (this *NumberedTestRecord) GetVal() string {
 	return ""
 }
 
+type HeapTestRecord struct {
+	Key              *uint64 `protobuf:"fixed64,1,opt,name=key" json:"key,omitempty"`
+	Val              *string `protobuf:"bytes,2,req,name=val" json:"val,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *HeapTestRecord) Reset()         { *this = HeapTestRecord{} }
+func (this *HeapTestRecord) String() string { return proto.CompactTextString(this) }
+func (*HeapTestRecord) ProtoMessage()       {}
+
+func (this *HeapTestRecord) GetKey() uint64 {
+	if this != nil && this.Key != nil {
+		return *this.Key
+	}
+	return 0
+}
+
+func (this *HeapTestRecord) GetVal() string {
+	if this != nil && this.Val != nil {
+		return *this.Val
+	}
+	return ""
+}
+
 func init() {
 }
@@ -0,0 +1,148 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// Error indicating a record that does not fit the database.
+var ErrSchemaMismatch = errors.New("protodb: record does not match database schema")
+
+// Error describing why a record does not fit the database. It matches
+// ErrSchemaMismatch.
+type SchemaError struct {
+	Record string // Type of the record.
+	Reason string // Description of the mismatch.
+}
+
+func (err *SchemaError) Error() string {
+	return "protodb: record type " + err.Record + " does not match database schema: " + err.Reason
+}
+
+// Get the general schema mismatch error.
+func (err *SchemaError) Unwrap() error {
+	return ErrSchemaMismatch
+}
+
+// Combination of record and database type whose compatibility has
+// been checked.
+type recordShape struct {
+	rtype  reflect.Type
+	dbtype DatabaseType
+}
+
+var (
+	recordShapes     = make(map[recordShape]error)
+	recordShapesLock sync.RWMutex
+)
+
+var (
+	uint32PtrType = reflect.TypeOf((*uint32)(nil))
+	uint64PtrType = reflect.TypeOf((*uint64)(nil))
+	messageType   = reflect.TypeOf((*proto.Message)(nil)).Elem()
+)
+
+// Check whether a record can be stored in a database of the given
+// type. The result of the type check is cached per combination of
+// types; nil pointers are rejected in any case.
+func checkRecord(rec proto.Message, dbtype DatabaseType) (err error) {
+	rtype := reflect.TypeOf(rec)
+	if rtype == nil {
+		err = &SchemaError{Record: "nil", Reason: "record is nil"}
+		return
+	}
+
+	shape := recordShape{rtype, dbtype}
+
+	recordShapesLock.RLock()
+	err, ok := recordShapes[shape]
+	recordShapesLock.RUnlock()
+	if !ok {
+		err = checkRecordShape(rtype, dbtype)
+
+		recordShapesLock.Lock()
+		recordShapes[shape] = err
+		recordShapesLock.Unlock()
+	}
+
+	if err == nil && reflect.ValueOf(rec).IsNil() {
+		err = &SchemaError{Record: rtype.String(), Reason: "record is nil"}
+	}
+
+	return
+}
+
+// Check the compatibility of a record type with a database type.
+func checkRecordShape(rtype reflect.Type, dbtype DatabaseType) (err error) {
+	mismatch := func(reason string) error {
+		return &SchemaError{Record: rtype.String(), Reason: reason}
+	}
+
+	if rtype.Kind() != reflect.Ptr || rtype.Elem().Kind() != reflect.Struct {
+		err = mismatch("record is not a pointer to a struct")
+		return
+	}
+
+	field, ok := rtype.Elem().FieldByName("Key")
+	if !ok {
+		err = mismatch("record has no key field")
+		return
+	}
+
+	switch dbtype {
+	case Numbered, Queue:
+		if field.Type != uint32PtrType {
+			err = mismatch("key must be an unsigned 32-bit integer for numbered and queue databases")
+		}
+
+	case Heap:
+		if field.Type != uint64PtrType {
+			err = mismatch("key must be an unsigned 64-bit integer for heap databases")
+		}
+
+	default:
+		if field.Type.Kind() != reflect.Ptr || !field.Type.Implements(messageType) {
+			err = mismatch("key must be a protobuf message")
+		}
+	}
+
+	return
+}
+
+// Check whether a record can be stored in the database.
+func (db Database) checkRecord(rec proto.Message) (dbtype DatabaseType, err error) {
+	dbtype, err = db.Type()
+	if err != nil {
+		return
+	}
+
+	err = checkRecord(rec, dbtype)
+	return
+}
@@ -0,0 +1,109 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+)
+
+func TestSchemaMismatch(t *testing.T) {
+	mismatches := map[DatabaseType][]proto.Message{
+		BTree:    {&NumberedTestRecord{Val: proto.String("x")}, &TestRecord_Key{Val: proto.String("x")}},
+		Hash:     {&HeapTestRecord{Val: proto.String("x")}, &TestRecord_Key{Val: proto.String("x")}},
+		Numbered: {&TestRecord{Val: proto.String("x")}, &HeapTestRecord{Val: proto.String("x")}},
+		Queue:    {&TestRecord{Val: proto.String("x")}, &HeapTestRecord{Val: proto.String("x")}},
+		Heap:     {&TestRecord{Val: proto.String("x")}, &NumberedTestRecord{Val: proto.String("x")}},
+	}
+
+	for dbtype, recs := range mismatches {
+		withDb(t, dbtype, func(db Database) {
+			for _, rec := range recs {
+				err := db.Put(NoTransaction, true, rec)
+				if !errors.Is(err, ErrSchemaMismatch) {
+					t.Error("Put of mismatched record did not fail:", dbtype, rec, err)
+				}
+
+				err = db.Get(NoTransaction, false, rec)
+				if !errors.Is(err, ErrSchemaMismatch) {
+					t.Error("Get of mismatched record did not fail:", dbtype, rec, err)
+				}
+
+				err = db.Del(NoTransaction, rec)
+				if !errors.Is(err, ErrSchemaMismatch) {
+					t.Error("Del of mismatched record did not fail:", dbtype, rec, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaNilRecord(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		var rec *TestRecord
+
+		err := db.Put(NoTransaction, false, rec)
+		if !errors.Is(err, ErrSchemaMismatch) {
+			t.Error("Put of nil record did not fail:", err)
+		}
+
+		err = db.Get(NoTransaction, false, rec)
+		if !errors.Is(err, ErrSchemaMismatch) {
+			t.Error("Get of nil record did not fail:", err)
+		}
+
+		err = db.Del(NoTransaction, rec)
+		if !errors.Is(err, ErrSchemaMismatch) {
+			t.Error("Del of nil record did not fail:", err)
+		}
+	})
+}
+
+func TestSchemaPrototype(t *testing.T) {
+	_, err := OpenDatabase(NoEnvironment, NoTransaction, "", &DatabaseConfig{
+		Create: true,
+		Type:   Numbered,
+		Record: &TestRecord{},
+	})
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Error("Opened database with mismatched record prototype:", err)
+	}
+
+	db, err := OpenDatabase(NoEnvironment, NoTransaction, "", &DatabaseConfig{
+		Create: true,
+		Type:   Numbered,
+		Record: &NumberedTestRecord{},
+	})
+	if err != nil {
+		t.Fatal("Failed to open database with matching record prototype:", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+}
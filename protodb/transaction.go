@@ -25,7 +25,15 @@
 
 package protodb
 
+import (
+	"math/rand"
+	"time"
+	"unsafe"
+)
+
 /*
+ #include <stdlib.h>
+ #include <string.h>
  #include <db.h>
  static inline int db_env_txn_begin(DB_ENV *env, DB_TXN *parent, DB_TXN **txn, u_int32_t flags) {
  	return env->txn_begin(env, parent, txn, flags);
@@ -36,6 +44,18 @@ package protodb
  static inline int db_txn_commit(DB_TXN *txn, u_int32_t flags) {
  	return txn->commit(txn, flags);
  }
+ static inline u_int32_t db_txn_id(DB_TXN *txn) {
+ 	return txn->id(txn);
+ }
+ static inline int db_txn_prepare(DB_TXN *txn, void *gid, size_t size) {
+ 	u_int8_t buf[DB_GID_SIZE];
+ 	memset(buf, 0, DB_GID_SIZE);
+ 	memcpy(buf, gid, size);
+ 	return txn->prepare(txn, buf);
+ }
+ static inline int db_env_txn_recover(DB_ENV *env, DB_PREPLIST *list, long count, long *found, u_int32_t flags) {
+ 	return env->txn_recover(env, list, count, found, flags);
+ }
 */
 import "C"
 
@@ -61,23 +81,60 @@ type TransactionConfig struct {
 
 // Transaction in a database environment.
 type Transaction struct {
-	ptr *C.DB_TXN
+	ptr    *C.DB_TXN
+	parent *C.DB_TXN // Parent transaction, if any.
+	env    *C.DB_ENV
 }
 
 // Special constant indicating no transaction should be used.
 var NoTransaction = Transaction{ptr: nil}
 
+// Get the identifier of the transaction, which is zero for
+// NoTransaction.
+func (txn Transaction) ID() uint32 {
+	if txn.ptr == nil {
+		return 0
+	}
+	return uint32(C.db_txn_id(txn.ptr))
+}
+
 // Perform an operation within a transaction. The transaction is
 // automatically committed if the action doesn't return an error. If
 // an error occurs, the transaction is automatically aborted. Any
 // error is passed through to the caller.
 func (env Environment) WithTransaction(config *TransactionConfig, action func(Transaction) error) (err error) {
-	var parent *C.DB_TXN
+	txn, err := env.Begin(config)
+	if err == nil {
+		defer func() {
+			if err != nil && txn.ptr != nil {
+				txn.abort()
+				txn.ptr = nil
+			}
+		}()
+	} else {
+		return
+	}
+
+	err = action(txn)
+	if err == nil {
+		err = txn.Commit()
+		txn.ptr = nil
+	} else {
+		return
+	}
+
+	return
+}
+
+// Begin a transaction, which must be resolved by calling Commit or
+// Abort, possibly after preparing it. WithTransaction takes care of
+// this for transactions that are resolved right away.
+func (env Environment) Begin(config *TransactionConfig) (txn Transaction, err error) {
 	var flags C.u_int32_t = C.DB_READ_COMMITTED
 
 	if config != nil {
 		if config.Parent != NoTransaction {
-			parent = config.Parent.ptr
+			txn.parent = config.Parent.ptr
 		}
 		if config.Isolation != 0 {
 			flags = C.u_int32_t(config.Isolation)
@@ -96,26 +153,171 @@ func (env Environment) WithTransaction(config *TransactionConfig, action func(Tr
 		}
 	}
 
-	var txn Transaction
-	err = check(C.db_env_txn_begin(env.ptr, parent, &txn.ptr, flags))
+	txn.env = env.ptr
+	scope := captureErrors(env.ptr)
+	err = check(C.db_env_txn_begin(env.ptr, txn.parent, &txn.ptr, flags))
+	detail := scope.end()
 	if err == nil {
-		defer func() {
-			if err != nil && txn.ptr != nil {
-				C.db_txn_abort(txn.ptr)
-				txn.ptr = nil
-			}
-		}()
+		beginChanges(txn.ptr, txn.parent)
 	} else {
+		err = &OpError{Op: "begin", Err: err, Detail: detail}
+	}
+
+	return
+}
+
+// Commit the transaction along with its unresolved child transactions.
+// The changes made in them are delivered to watchers, or handed to the
+// parent transaction if there is one. If committing fails, the
+// transaction is aborted. Committing NoTransaction fails with
+// ErrInvalid.
+func (txn Transaction) Commit() (err error) {
+	if txn.ptr == nil {
+		err = ErrInvalid
 		return
 	}
 
-	err = action(txn)
+	id := txn.ID()
+	scope := captureErrors(txn.env)
+	err = txn.commit()
+	detail := scope.end()
+	if err != nil {
+		err = &OpError{Op: "commit", TxnID: id, Err: err, Detail: detail}
+	}
+	return
+}
+
+// Abort the transaction along with its unresolved child transactions
+// and discard the changes made in them. Aborting NoTransaction fails
+// with ErrInvalid.
+func (txn Transaction) Abort() (err error) {
+	if txn.ptr == nil {
+		err = ErrInvalid
+		return
+	}
+
+	id := txn.ID()
+	scope := captureErrors(txn.env)
+	err = txn.abort()
+	detail := scope.end()
+	if err != nil {
+		err = &OpError{Op: "abort", TxnID: id, Err: err, Detail: detail}
+	}
+	return
+}
+
+// Commit the transaction and deliver the changes recorded for it to
+// watchers, or hand them to the parent transaction if there is one.
+func (txn Transaction) commit() (err error) {
+	err = check(C.db_txn_commit(txn.ptr, 0))
 	if err == nil {
-		err = check(C.db_txn_commit(txn.ptr, 0))
-		txn.ptr = nil
+		commitChanges(txn.ptr, txn.parent)
 	} else {
+		abortChanges(txn.ptr, txn.parent)
+	}
+	return
+}
+
+// Abort the transaction and discard the changes recorded for it.
+func (txn Transaction) abort() (err error) {
+	abortChanges(txn.ptr, txn.parent)
+	err = check(C.db_txn_abort(txn.ptr))
+	return
+}
+
+// Bounds of the delay before retrying a transaction that failed due to
+// a lock conflict.
+const (
+	minRetryDelay = time.Millisecond
+	maxRetryDelay = 100 * time.Millisecond
+)
+
+// Get the delay before the retry following the given number of failed
+// attempts. The delay doubles with every attempt up to maxRetryDelay
+// and is randomized to keep conflicting transactions apart.
+func retryDelay(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 7 {
+		delay = minRetryDelay << uint(attempt)
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Maximum length of a global transaction identifier.
+const GIDSize = C.DB_GID_SIZE
+
+// Prepare the transaction for a two-phase commit under the given
+// global identifier, which is padded with zeros to GIDSize bytes.
+// Once prepared, the transaction survives a restart of the environment.
+// It is resolved by Commit or Abort, or after a restart through
+// RecoverPrepared. Preparing NoTransaction fails with ErrInvalid.
+func (txn Transaction) Prepare(gid []byte) (err error) {
+	if txn.ptr == nil || len(gid) > GIDSize {
+		err = ErrInvalid
 		return
 	}
 
+	cgid := C.CBytes(gid)
+	defer C.free(cgid)
+
+	scope := captureErrors(txn.env)
+	err = check(C.db_txn_prepare(txn.ptr, cgid, C.size_t(len(gid))))
+	detail := scope.end()
+	if err != nil {
+		err = &OpError{Op: "prepare", TxnID: txn.ID(), Err: err, Detail: detail}
+	}
+
+	return
+}
+
+// Transaction that was prepared but not resolved when the environment
+// was last shut down. It is resolved by Commit or Abort like any other
+// transaction, but the changes made before the environment was
+// reopened are not delivered to watchers. Change log entries written
+// by the transaction are durable and become visible with it.
+type PreparedTransaction struct {
+	Transaction
+	GID []byte // Global identifier, including its zero padding.
+}
+
+// Number of prepared transactions retrieved at a time.
+const recoverBatchSize = 16
+
+// List the prepared transactions that are still unresolved after
+// recovery of the environment. Each of them must be committed or
+// aborted. The environment must have been opened with recovery.
+func (env Environment) RecoverPrepared() (txns []PreparedTransaction, err error) {
+	clist := (*C.DB_PREPLIST)(C.calloc(recoverBatchSize, C.size_t(unsafe.Sizeof(C.DB_PREPLIST{}))))
+	defer C.free(unsafe.Pointer(clist))
+
+	list := unsafe.Slice(clist, recoverBatchSize)
+
+	var flags C.u_int32_t = C.DB_FIRST
+	for {
+		var found C.long
+		scope := captureErrors(env.ptr)
+		err = check(C.db_env_txn_recover(env.ptr, clist, recoverBatchSize, &found, flags))
+		detail := scope.end()
+		if err != nil {
+			err = &OpError{Op: "recover", Err: err, Detail: detail}
+			return
+		}
+
+		for _, prep := range list[:found] {
+			txns = append(txns, PreparedTransaction{
+				Transaction: Transaction{ptr: prep.txn, env: env.ptr},
+				GID:         C.GoBytes(unsafe.Pointer(&prep.gid[0]), C.DB_GID_SIZE),
+			})
+		}
+
+		if found < recoverBatchSize {
+			break
+		}
+		flags = C.DB_NEXT
+	}
+
 	return
 }
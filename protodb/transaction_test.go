@@ -0,0 +1,303 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPrepare(t *testing.T) {
+	err := os.MkdirAll("test.env", 0755)
+	if err == nil {
+		defer os.RemoveAll("test.env")
+	} else {
+		t.Fatal("Failed to create environment home:", err)
+	}
+
+	env, err := OpenEnvironment("test.env", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Recover:       true,
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	prepared, err := env.RecoverPrepared()
+	if err != nil || len(prepared) != 0 {
+		t.Error("Fresh environment has prepared transactions:", prepared, err)
+	}
+
+	var db Database
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "test.db", &DatabaseConfig{
+			Create: true,
+			Type:   BTree,
+		})
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	err = env.WithTransaction(nil, func(txn Transaction) error {
+		return txn.Prepare(bytes.Repeat([]byte{1}, GIDSize+1))
+	})
+	if !errors.Is(err, ErrInvalid) {
+		t.Error("Overlong global identifier accepted:", err)
+	}
+
+	rec := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+		Val: proto.String("world"),
+	}
+
+	err = env.WithTransaction(nil, func(txn Transaction) error {
+		err := db.Put(txn, false, rec)
+		if err != nil {
+			return err
+		}
+		return txn.Prepare([]byte("gid-1"))
+	})
+	if err != nil {
+		t.Fatal("Prepared transaction failed to commit:", err)
+	}
+
+	ok, err := db.Exists(NoTransaction, rec)
+	if err != nil || !ok {
+		t.Error("Prepared record not committed:", ok, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
+
+func TestRecoverPrepared(t *testing.T) {
+	err := os.MkdirAll("test.env", 0755)
+	if err == nil {
+		defer os.RemoveAll("test.env")
+	} else {
+		t.Fatal("Failed to create environment home:", err)
+	}
+
+	config := &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Recover:       true,
+	}
+
+	env, err := OpenEnvironment("test.env", config)
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+
+	var db Database
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "test.db", &DatabaseConfig{
+			Create: true,
+			Type:   BTree,
+		})
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	recs := map[string]*TestRecord{
+		"gid-commit": {
+			Key: &TestRecord_Key{Val: proto.String("committed")},
+			Val: proto.String("world"),
+		},
+		"gid-abort": {
+			Key: &TestRecord_Key{Val: proto.String("aborted")},
+			Val: proto.String("world"),
+		},
+	}
+
+	for gid, rec := range recs {
+		txn, err := env.Begin(nil)
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+
+		err = db.Put(txn, false, rec)
+		if err != nil {
+			t.Fatal("Failed to put record:", err)
+		}
+
+		err = txn.Prepare([]byte(gid))
+		if err != nil {
+			t.Fatal("Failed to prepare transaction:", err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+
+	env, err = OpenEnvironment("test.env", config)
+	if err != nil {
+		t.Fatal("Failed to reopen environment:", err)
+	}
+
+	prepared, err := env.RecoverPrepared()
+	if err != nil || len(prepared) != len(recs) {
+		t.Fatal("Prepared transactions not recovered:", prepared, err)
+	}
+
+	for _, ptxn := range prepared {
+		gid := string(bytes.TrimRight(ptxn.GID, "\x00"))
+		if _, ok := recs[gid]; !ok || len(ptxn.GID) != GIDSize {
+			t.Error("Unexpected global identifier recovered:", ptxn.GID)
+			continue
+		}
+
+		if gid == "gid-commit" {
+			err = ptxn.Commit()
+		} else {
+			err = ptxn.Abort()
+		}
+		if err != nil {
+			t.Error("Failed to resolve prepared transaction:", gid, err)
+		}
+	}
+
+	err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "test.db", nil)
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to reopen database:", err)
+	}
+
+	ok, err := db.Exists(NoTransaction, recs["gid-commit"])
+	if err != nil || !ok {
+		t.Error("Committed prepared record not visible:", ok, err)
+	}
+
+	ok, err = db.Exists(NoTransaction, recs["gid-abort"])
+	if err != nil || ok {
+		t.Error("Aborted prepared record visible:", ok, err)
+	}
+
+	prepared, err = env.RecoverPrepared()
+	if err != nil || len(prepared) != 0 {
+		t.Error("Resolved transactions still prepared:", prepared, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Error("Failed to close database:", err)
+	}
+
+	err = env.Close()
+	if err != nil {
+		t.Error("Failed to close environment:", err)
+	}
+}
+
+func TestBegin(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		txn, err := env.Begin(nil)
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+		err = db.Put(txn, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		err = txn.Abort()
+		if err != nil {
+			t.Error("Abort failed:", err)
+		}
+
+		ok, err := db.Exists(NoTransaction, rec)
+		if err != nil || ok {
+			t.Error("Aborted record visible:", ok, err)
+		}
+
+		txn, err = env.Begin(nil)
+		if err != nil {
+			t.Fatal("Failed to begin transaction:", err)
+		}
+		err = db.Put(txn, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		err = txn.Commit()
+		if err != nil {
+			t.Error("Commit failed:", err)
+		}
+
+		ok, err = db.Exists(NoTransaction, rec)
+		if err != nil || !ok {
+			t.Error("Committed record not visible:", ok, err)
+		}
+	})
+}
+
+func TestNoTransaction(t *testing.T) {
+	if id := NoTransaction.ID(); id != 0 {
+		t.Error("No transaction has an identifier:", id)
+	}
+
+	err := NoTransaction.Commit()
+	if !errors.Is(err, ErrInvalid) {
+		t.Error("Committing no transaction succeeded:", err)
+	}
+
+	err = NoTransaction.Abort()
+	if !errors.Is(err, ErrInvalid) {
+		t.Error("Aborting no transaction succeeded:", err)
+	}
+
+	err = NoTransaction.Prepare([]byte("gid"))
+	if !errors.Is(err, ErrInvalid) {
+		t.Error("Preparing no transaction succeeded:", err)
+	}
+}
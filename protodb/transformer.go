@@ -0,0 +1,254 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+ #include <db.h>
+*/
+import "C"
+
+// Transformation of encoded record data, such as encryption. It is
+// applied after compression when storing records and before
+// decompression when retrieving them. The encoded key of the record is
+// passed along, so that the stored data can be bound to it. Sealed
+// data may start with any byte, including the metadata marker 0xf7;
+// since it is then always stored behind a metadata header, it is never
+// mistaken for one.
+type Transformer interface {
+	// Transform data for storage under a key.
+	Seal(key, buf []byte) ([]byte, error)
+	// Reverse the transformation of data stored under a key.
+	Open(key, buf []byte) ([]byte, error)
+}
+
+// Transformer that can be made to reject data it did not produce.
+type strictTransformer interface {
+	strict() Transformer
+}
+
+var (
+	resealedLock sync.RWMutex
+	resealed     = make(map[*C.DB]bool)
+)
+
+// Remember that all data of a database has been resealed.
+func (db Database) markResealed() {
+	resealedLock.Lock()
+	defer resealedLock.Unlock()
+
+	resealed[db.ptr] = true
+}
+
+// Forget that a database has been resealed.
+func unmarkResealed(ptr *C.DB) {
+	resealedLock.Lock()
+	defer resealedLock.Unlock()
+
+	delete(resealed, ptr)
+}
+
+// Get the transformer to open stored data with, which is strict if
+// possible once all data has been resealed.
+func (db Database) opener() Transformer {
+	resealedLock.RLock()
+	defer resealedLock.RUnlock()
+
+	if st, ok := db.transformer.(strictTransformer); ok && resealed[db.ptr] {
+		return st.strict()
+	}
+	return db.transformer
+}
+
+// Apply the transformer of the database to data for storage.
+func (db Database) seal(key, buf []byte) (out []byte, err error) {
+	if db.transformer == nil {
+		out = buf
+		return
+	}
+
+	out, err = db.transformer.Seal(key, buf)
+	return
+}
+
+// Reverse the transformer of the database on stored data.
+func (db Database) open(key, buf []byte) (out []byte, err error) {
+	if db.transformer == nil {
+		out = buf
+		return
+	}
+
+	out, err = db.opener().Open(key, buf)
+	return
+}
+
+// Source of encryption keys, for example a key management service.
+type KeyProvider interface {
+	// Get the identifier and the value of the key to encrypt with.
+	CurrentKey() (id string, key []byte, err error)
+	// Get the value of the key with the given identifier.
+	Key(id string) (key []byte, err error)
+}
+
+// Error indicating an unavailable encryption key.
+var ErrUnknownKey = errors.New("protodb: unknown encryption key")
+
+// Error indicating unencrypted data where encrypted data is required.
+var ErrUnencrypted = errors.New("protodb: unencrypted data")
+
+// Key provider serving keys from a fixed set. Rotating keys is a
+// matter of adding a new one and changing the current identifier.
+type StaticKeys struct {
+	Current string            // Identifier of the key to encrypt with.
+	Keys    map[string][]byte // AES keys by identifier.
+}
+
+func (keys *StaticKeys) CurrentKey() (id string, key []byte, err error) {
+	id = keys.Current
+	key, err = keys.Key(id)
+	return
+}
+
+func (keys *StaticKeys) Key(id string) (key []byte, err error) {
+	key, ok := keys.Keys[id]
+	if !ok {
+		err = ErrUnknownKey
+	}
+	return
+}
+
+// Transformer encrypting record data with AES-GCM. Encrypted data
+// starts with the byte 0xfe, which no protobuf encoding starts with.
+// Every value is tagged with the identifier of the key it was
+// encrypted with, so old records remain readable after a key rotation
+// as long as the key provider still knows their key. The header and
+// the record key are authenticated along with the data, so values
+// cannot be moved to other keys.
+//
+// Unencrypted data is passed through unless the transformer is strict,
+// in which case it fails with ErrUnencrypted. Once Reseal has
+// encrypted all records of a database, the database handle opens data
+// strictly anyway; set Strict to keep it that way after reopening.
+type EnvelopeEncryption struct {
+	Keys   KeyProvider // Source of encryption keys.
+	Strict bool        // Reject unencrypted data.
+}
+
+func (enc EnvelopeEncryption) strict() Transformer {
+	enc.Strict = true
+	return enc
+}
+
+// Get the additional data authenticated with an encrypted value.
+func envelopeAAD(header, key []byte) []byte {
+	return append(header[:len(header):len(header)], key...)
+}
+
+// Create an AES-GCM cipher from a key.
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+	return
+}
+
+func (enc EnvelopeEncryption) Seal(key, buf []byte) (out []byte, err error) {
+	id, secret, err := enc.Keys.CurrentKey()
+	if err != nil {
+		return
+	}
+	if len(id) > 255 {
+		err = ErrInvalid
+		return
+	}
+
+	aead, err := newGCM(secret)
+	if err != nil {
+		return
+	}
+
+	out = make([]byte, 2+len(id)+aead.NonceSize(), 2+len(id)+aead.NonceSize()+len(buf)+aead.Overhead())
+	out[0] = encryptedMarker
+	out[1] = byte(len(id))
+	copy(out[2:], id)
+
+	nonce := out[2+len(id):]
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+
+	out = aead.Seal(out, nonce, buf, envelopeAAD(out[:2+len(id)], key))
+
+	return
+}
+
+func (enc EnvelopeEncryption) Open(key, buf []byte) (out []byte, err error) {
+	if len(buf) < 2 || buf[0] != encryptedMarker {
+		if enc.Strict {
+			err = ErrUnencrypted
+		} else {
+			out = buf
+		}
+		return
+	}
+
+	hlen := 2 + int(buf[1])
+	if len(buf) < hlen {
+		err = ErrInvalid
+		return
+	}
+
+	secret, err := enc.Keys.Key(string(buf[2:hlen]))
+	if err != nil {
+		return
+	}
+
+	aead, err := newGCM(secret)
+	if err != nil {
+		return
+	}
+	if len(buf) < hlen+aead.NonceSize() {
+		err = ErrInvalid
+		return
+	}
+
+	nonce := buf[hlen : hlen+aead.NonceSize()]
+	out, err = aead.Open(nil, nonce, buf[hlen+aead.NonceSize():], envelopeAAD(buf[:hlen], key))
+
+	return
+}
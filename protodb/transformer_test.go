@@ -0,0 +1,251 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+)
+
+func TestEnvelopeEncryption(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 16),
+		},
+	}
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Transformer: EnvelopeEncryption{Keys: keys}}, func(db Database) {
+		rec0 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec0)
+		if err != nil {
+			t.Error("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, rec0, 0, 1024)
+		if err != nil {
+			t.Error("Partial get failed:", err)
+		}
+		if bytes.Contains(buf, []byte("world")) || !bytes.Contains(buf, []byte("k1")) {
+			t.Error("Stored data is not encrypted:", buf)
+		}
+
+		keys.Keys["k2"] = bytes.Repeat([]byte{2}, 16)
+		keys.Current = "k2"
+
+		rec1 := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+		}
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get after key rotation failed:", err)
+		}
+		if *rec0.Val != *rec1.Val {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+
+		count, err := db.Reseal(NoEnvironment, 0)
+		if err != nil || count != 1 {
+			t.Error("Reseal failed:", count, err)
+		}
+
+		delete(keys.Keys, "k1")
+
+		err = db.Get(NoTransaction, false, rec1)
+		if err != nil {
+			t.Error("Get after reseal failed:", err)
+		}
+		if *rec0.Val != *rec1.Val {
+			t.Error("Retrieved value mismatch:", rec0, rec1)
+		}
+	})
+}
+
+func TestEnvelopeEncryptionTampering(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 16),
+		},
+	}
+
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Transformer: EnvelopeEncryption{Keys: keys}}, func(db Database) {
+		a := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("a")},
+			Val: proto.String("alice"),
+		}
+		b := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("b")},
+			Val: proto.String("bob"),
+		}
+
+		err := db.Put(NoTransaction, false, a, b)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		buf, err := db.GetPartial(NoTransaction, a, 0, 1024)
+		if err != nil {
+			t.Fatal("Partial get failed:", err)
+		}
+		err = db.PutPartial(NoTransaction, b, 0, 1024, buf)
+		if err != nil {
+			t.Fatal("Partial put failed:", err)
+		}
+
+		err = db.Get(NoTransaction, false, &TestRecord{Key: &TestRecord_Key{Val: proto.String("b")}})
+		if err == nil {
+			t.Error("Data moved to another key accepted")
+		}
+
+		plain, err := proto.Marshal(&TestRecord{Val: proto.String("mallory")})
+		if err != nil {
+			t.Fatal("Marshal failed:", err)
+		}
+		c := &TestRecord{Key: &TestRecord_Key{Val: proto.String("c")}}
+		err = db.PutPartial(NoTransaction, c, 0, 0, plain)
+		if err != nil {
+			t.Fatal("Partial put failed:", err)
+		}
+
+		err = db.Get(NoTransaction, false, c)
+		if err != nil || c.GetVal() != "mallory" {
+			t.Error("Unencrypted data not readable before reseal:", c, err)
+		}
+
+		err = db.Del(NoTransaction, b)
+		if err != nil {
+			t.Fatal("Del failed:", err)
+		}
+
+		count, err := db.Reseal(NoEnvironment, 1)
+		if err != nil || count != 2 {
+			t.Fatal("Reseal failed:", count, err)
+		}
+
+		err = db.Get(NoTransaction, false, c)
+		if err != nil || c.GetVal() != "mallory" {
+			t.Error("Resealed data not readable:", c, err)
+		}
+
+		d := &TestRecord{Key: &TestRecord_Key{Val: proto.String("d")}}
+		err = db.PutPartial(NoTransaction, d, 0, 0, plain)
+		if err != nil {
+			t.Fatal("Partial put failed:", err)
+		}
+
+		err = db.Get(NoTransaction, false, d)
+		if !errors.Is(err, ErrUnencrypted) {
+			t.Error("Unencrypted data accepted after reseal:", d, err)
+		}
+	})
+}
+
+func TestEnvelopeEncryptionStrict(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "k1",
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 16),
+		},
+	}
+	enc := EnvelopeEncryption{Keys: keys, Strict: true}
+
+	out, err := enc.Seal([]byte("key"), []byte("data"))
+	if err != nil {
+		t.Fatal("Seal failed:", err)
+	}
+
+	buf, err := enc.Open([]byte("key"), out)
+	if err != nil || string(buf) != "data" {
+		t.Error("Open failed:", buf, err)
+	}
+
+	_, err = enc.Open([]byte("other"), out)
+	if err == nil {
+		t.Error("Data opened under another key")
+	}
+
+	_, err = enc.Open([]byte("key"), []byte("data"))
+	if !errors.Is(err, ErrUnencrypted) {
+		t.Error("Unencrypted data accepted by strict transformer:", err)
+	}
+}
+
+// Transformer whose output looks like the header of an expired record.
+type markerTransformer struct{}
+
+func (markerTransformer) Seal(key, buf []byte) ([]byte, error) {
+	return append([]byte{metadataMarker, metaExpires, 0x02}, buf...), nil
+}
+
+func (markerTransformer) Open(key, buf []byte) ([]byte, error) {
+	if len(buf) < 3 || buf[0] != metadataMarker {
+		return nil, ErrInvalid
+	}
+	return buf[3:], nil
+}
+
+func TestTransformerMarker(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Transformer: markerTransformer{}}, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		ok, err := db.Exists(NoTransaction, &TestRecord{Key: rec.Key})
+		if err != nil || !ok {
+			t.Error("Record with marker data not found:", ok, err)
+		}
+
+		count, err := db.DeleteExpired(NoEnvironment, 0)
+		if err != nil || count != 0 {
+			t.Error("Record with marker data deleted as expired:", count, err)
+		}
+
+		count, err = db.Reseal(NoEnvironment, 0)
+		if err != nil || count != 1 {
+			t.Error("Reseal failed:", count, err)
+		}
+
+		got := &TestRecord{Key: rec.Key}
+		err = db.Get(NoTransaction, false, got)
+		if err != nil || got.GetVal() != "world" {
+			t.Error("Record with marker data not readable:", got, err)
+		}
+	})
+}
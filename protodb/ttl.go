@@ -0,0 +1,219 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ #include <stdlib.h>
+ #include <db.h>
+*/
+import "C"
+
+// Default number of records examined per transaction while deleting
+// expired records or resealing records.
+const defaultSweepBatch = 100
+
+// Maximum number of attempts to process a batch of records in the face
+// of lock conflicts.
+const maxBatchAttempts = 16
+
+// Examine up to batch records following the given raw key, or from
+// the start of the database, and delete the expired ones. Returns the
+// key to continue after and whether the end of the database has been
+// reached.
+func (db Database) sweep(txn Transaction, after []byte, batch int) (next []byte, deleted int, done bool, err error) {
+	cur, err := db.Cursor(txn)
+	if err == nil {
+		defer func() {
+			cerr := cur.Close()
+			if err == nil {
+				err = cerr
+			}
+		}()
+	} else {
+		return
+	}
+
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_REALLOC
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_REALLOC
+	data.dlen = maxMetadataSize
+	defer func() {
+		C.free(key.data)
+		C.free(data.data)
+	}()
+
+	flags, err := cur.resume(after)
+	if err != nil {
+		return
+	} else if flags == C.DB_NEXT {
+		next = after
+	}
+
+	for i := 0; i < batch; i++ {
+		err = cur.get(&key, &data, flags)
+		if IsNotFound(err) {
+			err = nil
+			done = true
+			return
+		} else if err != nil {
+			return
+		}
+
+		flags = C.DB_NEXT
+
+		meta, _, _ := splitMeta(C.GoBytes(data.data, C.int(data.size)))
+		if meta.expired() && !meta.deleted {
+			err = cur.Del()
+			if err != nil {
+				return
+			}
+			deleted++
+		} else {
+			next = C.GoBytes(key.data, C.int(key.size))
+		}
+	}
+
+	return
+}
+
+// Delete all expired records from the database, examining at most
+// batch records per transaction. Without an environment, no
+// transactions are used. A batch failing due to lock conflicts is
+// retried up to maxBatchAttempts times before the error is returned.
+// The deletions are reported to watchers and change logs if the
+// database was opened with a Record prototype. Expired records of
+// versioned databases are replaced by tombstones, see Del. Databases
+// with sorted duplicates cannot hold records with a time to live, so
+// nothing is deleted from them.
+func (db Database) DeleteExpired(env Environment, batch int) (count int, err error) {
+	defer db.annotate("delete expired", NoTransaction, nil, &err)()
+
+	if db.duplicates {
+		return
+	}
+
+	count, err = db.batches(env, batch, db.sweep)
+	return
+}
+
+// Pass over the database in steps examining at most batch records
+// each, using a transaction per step unless there is no environment.
+// Every step continues after the raw key returned by the previous one
+// and steps failing due to a lock conflict are retried a limited number
+// of times. Returns the total count reported by the steps.
+func (db Database) batches(env Environment, batch int, step func(txn Transaction, after []byte, batch int) (next []byte, count int, done bool, err error)) (count int, err error) {
+	if batch <= 0 {
+		batch = defaultSweepBatch
+	}
+
+	var after []byte
+	attempt := 0
+	for done := false; !done; {
+		var next []byte
+		var n int
+
+		run := func(txn Transaction) (err error) {
+			next, n, done, err = step(txn, after, batch)
+			return
+		}
+
+		if env == NoEnvironment {
+			err = run(NoTransaction)
+		} else {
+			err = env.WithTransaction(nil, run)
+		}
+		if IsRetryable(err) {
+			attempt++
+			if attempt >= maxBatchAttempts {
+				return
+			}
+			time.Sleep(retryDelay(attempt - 1))
+			done = false
+			continue
+		} else if err != nil {
+			return
+		}
+
+		after = next
+		count += n
+		attempt = 0
+	}
+
+	return
+}
+
+// Start a goroutine deleting expired records from the database at the
+// given interval, as DeleteExpired does. Failures are passed to
+// onError, which is called in the goroutine of the sweeper, or
+// reported to the logger of the database if onError is nil. The
+// returned function stops the sweeper and waits for it to finish.
+func (db Database) StartSweeper(env Environment, interval time.Duration, batch int, onError func(error)) (stop func()) {
+	if onError == nil {
+		onError = func(err error) {
+			if logger := db.logger(); logger != nil {
+				logger.Error("failed to delete expired records", "error", err)
+			}
+		}
+	}
+
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+
+			_, err := db.DeleteExpired(env, batch)
+			if err != nil {
+				onError(err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(quit)
+			<-finished
+		})
+	}
+	return
+}
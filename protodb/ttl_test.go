@@ -0,0 +1,233 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		short := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("a")},
+			Val: proto.String("short"),
+		}
+		long := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("b")},
+			Val: proto.String("long"),
+		}
+
+		err := db.PutWithTTL(NoTransaction, false, 20*time.Millisecond, short)
+		if err != nil {
+			t.Fatal("Put with TTL failed:", err)
+		}
+		err = db.Put(NoTransaction, false, long)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		rec := &TestRecord{Key: &TestRecord_Key{Val: proto.String("a")}}
+		err = db.Get(NoTransaction, false, rec)
+		if err != nil || rec.GetVal() != "short" {
+			t.Error("Get before expiry failed:", rec, err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+
+		err = db.Get(NoTransaction, false, rec)
+		if !IsNotFound(err) {
+			t.Error("Expired record retrieved:", rec, err)
+		}
+		if rec.Val != nil || rec.Key.GetVal() != "a" {
+			t.Error("Expired record data left behind:", rec)
+		}
+
+		ok, err := db.Exists(NoTransaction, short)
+		if err != nil || ok {
+			t.Error("Expired record exists:", ok, err)
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to open cursor:", err)
+		}
+
+		err = cur.First(rec)
+		if err != nil || rec.GetVal() != "long" {
+			t.Error("Cursor did not skip expired record:", rec, err)
+		}
+
+		rec = &TestRecord{}
+		err = cur.FirstKey(rec)
+		if err != nil || rec.Key.GetVal() != "b" {
+			t.Error("Key cursor did not skip expired record:", rec, err)
+		}
+
+		err = cur.Close()
+		if err != nil {
+			t.Error("Failed to close cursor:", err)
+		}
+
+		n, err := db.DeleteExpired(NoEnvironment, 1)
+		if err != nil || n != 1 {
+			t.Error("Expired records not deleted:", n, err)
+		}
+
+		n, err = db.DeleteExpired(NoEnvironment, 1)
+		if err != nil || n != 0 {
+			t.Error("Expired records deleted twice:", n, err)
+		}
+
+		ok, err = db.Exists(NoTransaction, long)
+		if err != nil || !ok {
+			t.Error("Unexpired record does not exist:", ok, err)
+		}
+	})
+}
+
+func TestSweeper(t *testing.T) {
+	withEnv(t, func(env Environment) {
+		var db Database
+		err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:   true,
+				Type:     BTree,
+				Name:     "cache",
+				InMemory: true,
+				TTL:      10 * time.Millisecond,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		defer db.Close()
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Put(txn, false, rec)
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		stop := db.StartSweeper(env, 20*time.Millisecond, 10, nil)
+		time.Sleep(100 * time.Millisecond)
+		stop()
+
+		buf, err := db.GetPartial(NoTransaction, rec, 0, 1024)
+		if !IsNotFound(err) {
+			t.Error("Expired record not swept:", buf, err)
+		}
+	})
+}
+
+func TestSweeperErrors(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, offsets Database) {
+		records := openJobQueue(t, env, "changes")
+		defer records.Close()
+
+		log, err := NewChangeLog(records, offsets)
+		if err != nil {
+			t.Fatal("Failed to create change log:", err)
+		}
+
+		var db Database
+		err = env.WithTransaction(nil, func(txn Transaction) (err error) {
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:    true,
+				Type:      BTree,
+				Name:      "cache",
+				InMemory:  true,
+				TTL:       time.Millisecond,
+				ChangeLog: log,
+			})
+			if err == nil {
+				err = db.Put(txn, false, &TestRecord{
+					Key: &TestRecord_Key{Val: proto.String("hello")},
+					Val: proto.String("world"),
+				})
+			}
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to set up database:", err)
+		}
+		defer db.Close()
+
+		// Logged deletions without a transaction are rejected.
+		errs := make(chan error, 1)
+		stop := db.StartSweeper(NoEnvironment, 10*time.Millisecond, 10, func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		})
+		defer stop()
+
+		select {
+		case err = <-errs:
+			if !errors.Is(err, ErrInvalid) {
+				t.Error("Unexpected sweeper error:", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Sweeper error not reported")
+		}
+	})
+}
+
+func TestConsumeExpired(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		err := db.PutWithTTL(NoTransaction, true, time.Millisecond, &NumberedTestRecord{Val: proto.String("a")})
+		if err != nil {
+			t.Fatal("Put with TTL failed:", err)
+		}
+		err = db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String("b")})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		rec := &NumberedTestRecord{}
+		err = db.Consume(NoTransaction, rec, false)
+		if err != nil || rec.GetVal() != "b" {
+			t.Error("Consume did not skip expired record:", rec, err)
+		}
+
+		err = db.Consume(NoTransaction, rec, false)
+		if !IsNotFound(err) {
+			t.Error("Consume from empty queue did not fail:", rec, err)
+		}
+	})
+}
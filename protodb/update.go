@@ -0,0 +1,154 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"time"
+)
+
+// Read a record, apply a function to it and store the result. The
+// record is locked for writing when it is read, so concurrent updates
+// within transactions are serialized instead of deadlocking. If there
+// is no live record with the key of the given one, the function
+// receives the given record unchanged, even if an expired or deleted
+// record is stored under the key. Any error returned by the function
+// is passed through to the caller and nothing is stored.
+func (db Database) Update(txn Transaction, rec proto.Message, fn func(proto.Message) error) (err error) {
+	defer db.annotate("update", txn, &rec, &err)()
+
+	// Fetching an expired record resets the given one.
+	given := proto.Clone(rec)
+
+	_, err = db.fetch(txn, rec, db.rmw())
+	if IsNotFound(err) {
+		rec.Reset()
+		proto.Merge(rec, given)
+		err = nil
+	} else if err != nil {
+		return
+	}
+
+	err = fn(rec)
+	if err != nil {
+		return
+	}
+
+	err = db.Put(txn, false, rec)
+	return
+}
+
+// Key of a counter.
+type counterKey struct {
+	Name             *string `protobuf:"bytes,1,opt,name=name"`
+	XXX_unrecognized []byte
+}
+
+func (key *counterKey) Reset()         { *key = counterKey{} }
+func (key *counterKey) String() string { return proto.CompactTextString(key) }
+func (*counterKey) ProtoMessage()      {}
+
+// Record of a counter.
+type counterRecord struct {
+	Key              *counterKey `protobuf:"bytes,1,opt,name=key"`
+	Value            *int64      `protobuf:"zigzag64,2,opt,name=value"`
+	XXX_unrecognized []byte
+}
+
+func (rec *counterRecord) Reset()         { *rec = counterRecord{} }
+func (rec *counterRecord) String() string { return proto.CompactTextString(rec) }
+func (*counterRecord) ProtoMessage()      {}
+
+func (rec *counterRecord) GetValue() int64 {
+	if rec != nil && rec.Value != nil {
+		return *rec.Value
+	}
+	return 0
+}
+
+// Maximum number of attempts to update a counter in the face of lock
+// conflicts.
+const maxCounterAttempts = 16
+
+// Named integer counters stored in a B-tree or hash database.
+type Counters struct {
+	env Environment
+	db  Database
+}
+
+// Create counters stored in the given database. Without an
+// environment, no transactions are used.
+func NewCounters(env Environment, db Database) *Counters {
+	return &Counters{env: env, db: db}
+}
+
+// Get the value of a counter, which is zero if it has never been
+// changed.
+func (c *Counters) Get(txn Transaction, name string) (value int64, err error) {
+	rec := &counterRecord{Key: &counterKey{Name: proto.String(name)}}
+
+	err = c.db.Get(txn, false, rec)
+	if err == nil {
+		value = rec.GetValue()
+	} else if IsNotFound(err) {
+		err = nil
+	}
+
+	return
+}
+
+// Add a delta to a counter and return its new value. The update runs
+// in a transaction of its own, which is retried after a growing delay
+// if it runs into a lock conflict.
+func (c *Counters) Add(name string, delta int64) (value int64, err error) {
+	add := func(txn Transaction) error {
+		rec := &counterRecord{Key: &counterKey{Name: proto.String(name)}}
+
+		return c.db.Update(txn, rec, func(proto.Message) error {
+			value = rec.GetValue() + delta
+			rec.Value = proto.Int64(value)
+			return nil
+		})
+	}
+
+	if c.env == NoEnvironment {
+		err = add(NoTransaction)
+		return
+	}
+
+	for attempt := 0; attempt < maxCounterAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt - 1))
+		}
+
+		err = c.env.WithTransaction(nil, add)
+		if !IsRetryable(err) {
+			break
+		}
+	}
+
+	return
+}
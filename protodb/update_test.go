@@ -0,0 +1,166 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdate(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec := &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}
+		appendWorld := func(msg proto.Message) error {
+			msg.(*TestRecord).Val = proto.String(msg.(*TestRecord).GetVal() + "world")
+			return nil
+		}
+
+		err := db.Update(NoTransaction, rec, appendWorld)
+		if err != nil {
+			t.Fatal("Update of new record failed:", err)
+		}
+
+		err = db.Update(NoTransaction, rec, appendWorld)
+		if err != nil {
+			t.Fatal("Update failed:", err)
+		}
+
+		cur := &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}
+		err = db.Get(NoTransaction, false, cur)
+		if err != nil || cur.GetVal() != "worldworld" {
+			t.Error("Updated value mismatch:", cur, err)
+		}
+
+		fail := errors.New("fail")
+		err = db.Update(NoTransaction, cur, func(msg proto.Message) error {
+			msg.(*TestRecord).Val = proto.String("lost")
+			return fail
+		})
+		if !errors.Is(err, fail) {
+			t.Error("Update error not passed through:", err)
+		}
+
+		err = db.Get(NoTransaction, false, cur)
+		if err != nil || cur.GetVal() != "worldworld" {
+			t.Error("Failed update stored:", cur, err)
+		}
+	})
+}
+
+func TestUpdateExpired(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.PutWithTTL(NoTransaction, false, time.Millisecond, rec)
+		if err != nil {
+			t.Fatal("Put with TTL failed:", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		cur := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("given"),
+		}
+		err = db.Update(NoTransaction, cur, func(msg proto.Message) error {
+			if msg.(*TestRecord).GetVal() != "given" {
+				t.Error("Update did not receive the given record:", msg)
+			}
+			msg.(*TestRecord).Val = proto.String("again")
+			return nil
+		})
+		if err != nil {
+			t.Fatal("Update of expired record failed:", err)
+		}
+
+		_, err = db.GetVersion(NoTransaction, cur)
+		if err != nil || cur.GetVal() != "again" {
+			t.Error("Updated value mismatch:", cur, err)
+		}
+	})
+}
+
+func TestCounters(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, db Database) {
+		counters := NewCounters(env, db)
+
+		value, err := counters.Add("hits", 5)
+		if err != nil || value != 5 {
+			t.Error("Add to new counter failed:", value, err)
+		}
+
+		value, err = counters.Add("hits", -2)
+		if err != nil || value != 3 {
+			t.Error("Add failed:", value, err)
+		}
+
+		value, err = counters.Get(NoTransaction, "hits")
+		if err != nil || value != 3 {
+			t.Error("Counter value mismatch:", value, err)
+		}
+
+		value, err = counters.Get(NoTransaction, "misses")
+		if err != nil || value != 0 {
+			t.Error("Unknown counter has a value:", value, err)
+		}
+	})
+}
+
+func TestConcurrentCounters(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, db Database) {
+		counters := NewCounters(env, db)
+
+		const adders, adds = 8, 25
+
+		var wg sync.WaitGroup
+		for i := 0; i < adders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for j := 0; j < adds; j++ {
+					_, err := counters.Add("hits", 1)
+					if err != nil {
+						t.Error("Concurrent add failed:", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := counters.Get(NoTransaction, "hits")
+		if err != nil || value != adders*adds {
+			t.Error("Concurrent additions lost:", value, err)
+		}
+	})
+}
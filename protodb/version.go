@@ -0,0 +1,260 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+)
+
+/*
+ #include <stdlib.h>
+ #include <db.h>
+ static inline int version_get(DB *db, DB_TXN *txn, DBT *key, DBT *data, u_int32_t flags) {
+ 	return db->get(db, txn, key, data, flags);
+ }
+ static inline int db_locking(DB *db) {
+ 	DB_ENV *env = db->get_env(db);
+ 	u_int32_t flags = 0;
+ 	if (env == NULL || env->get_open_flags(env, &flags) != 0) {
+ 		return 0;
+ 	}
+ 	return (flags & DB_INIT_LOCK) != 0;
+ }
+*/
+import "C"
+
+// Error indicating that a record has been changed concurrently.
+var ErrVersionConflict = errors.New("protodb: record version conflict")
+
+// Get the current version of a record and whether there is a live
+// record with the key of the given one at all. Live records stored
+// without a version have version zero. Only the metadata header of the
+// record data is transferred.
+func (db Database) version(txn Transaction, rec proto.Message, flags C.u_int32_t) (version uint64, live bool, err error) {
+	meta, found, err := db.storedMeta(txn, rec, flags)
+	live = found && !meta.expired()
+	if live {
+		version = meta.version
+	}
+
+	return
+}
+
+// Get the metadata stored with a record, whether it has expired or
+// not, and whether there is a record with the key of the given one at
+// all. Only the metadata header of the record data is transferred.
+func (db Database) storedMeta(txn Transaction, rec proto.Message, flags C.u_int32_t) (meta recordMeta, found bool, err error) {
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_PARTIAL | C.DB_DBT_REALLOC
+	data.dlen = maxMetadataSize
+	defer func() {
+		C.free(data.data)
+	}()
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = check(C.version_get(db.ptr, txn.ptr, &key, &data, flags))
+	if IsNotFound(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	found = true
+	meta, _, err = splitMeta(C.GoBytes(data.data, C.int(data.size)))
+
+	return
+}
+
+// Get the flags to lock records for writing when reading them, if the
+// environment of the database supports locking at all.
+func (db Database) rmw() C.u_int32_t {
+	if C.db_locking(db.ptr) != 0 {
+		return C.DB_RMW
+	}
+	return 0
+}
+
+// Determine the version of a record about to be written. Versions
+// continue from the stored record even if it has expired or has been
+// deleted, so they are never reused for a key. Adding a record to a
+// B-tree or hash database without overwriting fails with ErrKeyExists
+// if a live record exists; otherwise overwrite reports whether an
+// expired record or a tombstone must be replaced.
+func (db Database) nextVersion(txn Transaction, dbtype DatabaseType, append bool, rec proto.Message) (version uint64, overwrite bool, err error) {
+	version = 1
+	if append {
+		switch dbtype {
+		case Numbered, Queue, Heap:
+			return
+		}
+	}
+
+	meta, found, err := db.storedMeta(txn, rec, db.rmw())
+	if err != nil || !found {
+		return
+	}
+	if append && !meta.expired() {
+		err = ErrKeyExists
+		return
+	}
+
+	version = meta.version + 1
+	overwrite = append
+	return
+}
+
+// Check whether deleting records from the database leaves tombstones
+// keeping their versions. Queue databases do not reuse record numbers
+// until they wrap around, so their records are removed.
+func (db Database) tombstones() (ok bool, err error) {
+	if !db.versioned {
+		return
+	}
+
+	dbtype, err := db.Type()
+	ok = err == nil && dbtype != Queue
+	return
+}
+
+// Encode the tombstone replacing a record with the given metadata.
+func tombstone(meta recordMeta) []byte {
+	return recordMeta{version: meta.version, deleted: true}.prepend(nil, true)
+}
+
+// Get a record from the database together with its version. Records
+// of databases without versioned writes have version zero. Versions
+// count the writes to a key: deleting a record from a versioned
+// database other than a queue leaves a tombstone with its version,
+// and expired records keep theirs until they are swept, so a record
+// stored again under the same key continues with the next version and
+// is never mistaken for the one that was read.
+func (db Database) GetVersion(txn Transaction, rec proto.Message) (version uint64, err error) {
+	defer db.annotate("get version", txn, &rec, &err)()
+
+	meta, err := db.fetch(txn, rec, 0)
+	version = meta.version
+
+	return
+}
+
+// Get a single live record and its metadata from the database.
+func (db Database) fetch(txn Transaction, rec proto.Message, flags C.u_int32_t) (meta recordMeta, err error) {
+	var key, data C.DBT
+
+	key.flags |= C.DB_DBT_READONLY
+	data.flags |= C.DB_DBT_REALLOC
+	defer func() {
+		C.free(data.data)
+	}()
+
+	err = db.marshalKey(&key, rec)
+	if err != nil {
+		return
+	}
+
+	err = check(C.version_get(db.ptr, txn.ptr, &key, &data, flags))
+	if err != nil {
+		return
+	}
+
+	meta, err = db.unmarshalData(&key, &data, rec)
+	if err != nil {
+		return
+	} else if meta.expired() {
+		db.forget(&key, rec)
+		err = ErrNotFound
+		return
+	}
+
+	err = db.unmarshalKey(&key, rec)
+	return
+}
+
+// Check the version of a record before changing it. Version zero
+// stands for a missing record, so it conflicts with any live record,
+// even one stored without a version. Within a transaction the record
+// is locked for writing, which requires an environment with locking;
+// otherwise the operation fails with ErrInvalid.
+func (db Database) checkVersion(txn Transaction, rec proto.Message, version uint64) (err error) {
+	if !db.versioned || txn != NoTransaction && db.rmw() == 0 {
+		err = ErrInvalid
+		return
+	}
+
+	current, live, err := db.version(txn, rec, db.rmw())
+	if err != nil {
+		return
+	}
+	if live && (version == 0 || version != current) || !live && version != 0 {
+		err = ErrVersionConflict
+	}
+
+	return
+}
+
+// Store a record in a database with versioned writes, provided that
+// the stored record still has the given version, or does not exist if
+// the version is zero. Otherwise the operation fails with
+// ErrVersionConflict. Records stored before versioning was enabled
+// have version zero and must be rewritten with Put before they can be
+// changed conditionally. The check and the write are atomic if a
+// transaction is given, which requires an environment with locking.
+func (db Database) PutIfVersion(txn Transaction, rec proto.Message, version uint64) (err error) {
+	defer db.annotate("put if version", txn, &rec, &err)()
+
+	err = db.checkVersion(txn, rec, version)
+	if err != nil {
+		return
+	}
+
+	err = db.Put(txn, false, rec)
+	return
+}
+
+// Delete a record from a database with versioned writes, provided
+// that the stored record still has the given version. Otherwise the
+// operation fails with ErrVersionConflict. The check and the deletion
+// are atomic if a transaction is given, which requires an environment
+// with locking.
+func (db Database) DeleteIfVersion(txn Transaction, rec proto.Message, version uint64) (err error) {
+	defer db.annotate("delete if version", txn, &rec, &err)()
+
+	err = db.checkVersion(txn, rec, version)
+	if err != nil {
+		return
+	}
+
+	err = db.Del(txn, rec)
+	return
+}
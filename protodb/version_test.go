@@ -0,0 +1,294 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestVersionedWrites(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Versioned: true}, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.PutIfVersion(NoTransaction, rec, 0)
+		if err != nil {
+			t.Fatal("Put of new record failed:", err)
+		}
+
+		err = db.Put(NoTransaction, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		cur := &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}
+		version, err := db.GetVersion(NoTransaction, cur)
+		if err != nil || version != 2 || cur.GetVal() != "world" {
+			t.Error("Get version mismatch:", version, cur, err)
+		}
+
+		rec.Val = proto.String("stale")
+		err = db.PutIfVersion(NoTransaction, rec, 1)
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Error("Stale put succeeded:", err)
+		}
+
+		rec.Val = proto.String("fresh")
+		err = db.PutIfVersion(NoTransaction, rec, version)
+		if err != nil {
+			t.Error("Put with current version failed:", err)
+		}
+
+		err = db.DeleteIfVersion(NoTransaction, rec, version)
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Error("Stale delete succeeded:", err)
+		}
+
+		err = db.DeleteIfVersion(NoTransaction, rec, version+1)
+		if err != nil {
+			t.Error("Delete with current version failed:", err)
+		}
+
+		_, err = db.GetVersion(NoTransaction, cur)
+		if !IsNotFound(err) {
+			t.Error("Deleted record retrieved:", cur, err)
+		}
+	})
+}
+
+func TestVersionsAfterDelete(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Versioned: true}, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.Put(NoTransaction, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		err = db.Del(NoTransaction, rec)
+		if err != nil {
+			t.Fatal("Del failed:", err)
+		}
+
+		err = db.Del(NoTransaction, rec)
+		if !IsNotFound(err) {
+			t.Error("Deleting tombstone succeeded:", err)
+		}
+
+		ok, err := db.Exists(NoTransaction, rec)
+		if err != nil || ok {
+			t.Error("Tombstone visible:", ok, err)
+		}
+
+		err = db.Put(NoTransaction, true, rec)
+		if err != nil {
+			t.Fatal("Put replacing tombstone failed:", err)
+		}
+
+		err = db.Put(NoTransaction, true, rec)
+		if !IsKeyExists(err) {
+			t.Error("Put overwrote live record:", err)
+		}
+
+		rec.Val = proto.String("stale")
+		err = db.PutIfVersion(NoTransaction, rec, 1)
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Error("Put with version of deleted record succeeded:", err)
+		}
+
+		cur := &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}
+		version, err := db.GetVersion(NoTransaction, cur)
+		if err != nil || version != 2 || cur.GetVal() != "world" {
+			t.Error("Version of recreated record reused:", version, cur, err)
+		}
+	})
+}
+
+func TestLegacyVersion(t *testing.T) {
+	rec := &TestRecord{
+		Key: &TestRecord_Key{Val: proto.String("hello")},
+		Val: proto.String("world"),
+	}
+
+	db, err := OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{Create: true, Type: BTree})
+	if err == nil {
+		defer os.Remove("test.db")
+	} else {
+		t.Fatal("Failed to open database:", err)
+	}
+
+	err = db.Put(NoTransaction, false, rec)
+	if err != nil {
+		t.Fatal("Put failed:", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("Failed to close database:", err)
+	}
+
+	db, err = OpenDatabase(NoEnvironment, NoTransaction, "test.db", &DatabaseConfig{Versioned: true})
+	if err != nil {
+		t.Fatal("Failed to reopen database:", err)
+	}
+	defer db.Close()
+
+	err = db.PutIfVersion(NoTransaction, rec, 0)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Error("Put with version zero overwrote unversioned record:", err)
+	}
+}
+
+func TestVersionedWritesWithoutLocking(t *testing.T) {
+	env, err := OpenEnvironment("", &EnvironmentConfig{
+		Create:        true,
+		Transactional: true,
+		Private:       true,
+		InMemoryLogs:  true,
+	})
+	if err != nil {
+		t.Fatal("Failed to open environment:", err)
+	}
+	defer env.Close()
+
+	err = env.WithTransaction(nil, func(txn Transaction) error {
+		db, err := OpenDatabase(env, txn, "", &DatabaseConfig{
+			Create:    true,
+			Type:      BTree,
+			Name:      "versioned",
+			InMemory:  true,
+			Versioned: true,
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		defer db.Close()
+
+		return db.PutIfVersion(txn, &TestRecord{Key: &TestRecord_Key{Val: proto.String("hello")}}, 0)
+	})
+	if !errors.Is(err, ErrInvalid) {
+		t.Error("Atomic versioned put without locking accepted:", err)
+	}
+}
+
+func TestUnversionedWrites(t *testing.T) {
+	withDb(t, BTree, func(db Database) {
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err := db.PutIfVersion(NoTransaction, rec, 0)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Versioned put into unversioned database succeeded:", err)
+		}
+	})
+}
+
+func TestConcurrentVersionedWrites(t *testing.T) {
+	withEnv(t, func(env Environment) {
+		var db Database
+		err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+			db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:    true,
+				Type:      BTree,
+				Name:      "versioned",
+				InMemory:  true,
+				Versioned: true,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open database:", err)
+		}
+		defer db.Close()
+
+		key := &TestRecord_Key{Val: proto.String("hello")}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Put(txn, false, &TestRecord{Key: key, Val: proto.String("world")})
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		const writers = 2
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, writers)
+
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+
+				rec := &TestRecord{Key: key, Val: proto.String("writer")}
+				for {
+					errs[i] = env.WithTransaction(nil, func(txn Transaction) error {
+						return db.PutIfVersion(txn, rec, 1)
+					})
+					if !IsRetryable(errs[i]) {
+						break
+					}
+				}
+			}(i)
+		}
+
+		close(start)
+		wg.Wait()
+
+		won, lost := 0, 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case errors.Is(err, ErrVersionConflict):
+				lost++
+			default:
+				t.Error("Versioned put failed:", err)
+			}
+		}
+		if won != 1 || lost != writers-1 {
+			t.Error("Versioned puts did not exclude each other:", errs)
+		}
+
+		version, err := db.GetVersion(NoTransaction, &TestRecord{Key: key})
+		if err != nil || version != 2 {
+			t.Error("Version after concurrent puts mismatch:", version, err)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"reflect"
+	"sync"
+)
+
+/*
+ #include <db.h>
+*/
+import "C"
+
+// Kind of change made to a record.
+type ChangeKind int
+
+// Available kinds of changes.
+const (
+	Inserted ChangeKind = iota
+	Updated
+	Deleted
+)
+
+// Committed change to a record of a database.
+type Change struct {
+	Database Database      // Database containing the record.
+	Kind     ChangeKind    // Kind of the change.
+	Old      proto.Message // Previous record, nil for insertions.
+	New      proto.Message // Current record, nil for deletions.
+}
+
+// Callback receiving the committed changes to a database.
+type WatchFunc func(Change)
+
+type watcher struct {
+	fn WatchFunc
+}
+
+var (
+	watchers     = make(map[*C.DB][]*watcher)
+	pending      = make(map[*C.DB_TXN][]Change)
+	children     = make(map[*C.DB_TXN][]*C.DB_TXN)
+	watchersLock sync.RWMutex
+	pendingLock  sync.Mutex
+)
+
+// Subscribe to the changes made to the database. The callback is
+// invoked after the transaction making a change commits, in the
+// committing goroutine, and never for aborted transactions. Changes
+// made without a transaction are delivered immediately. Operations
+// that do not decode records, namely Reseal, DeleteExpired and Del on
+// cursors that have not retrieved any record, report their changes to
+// watchers and change logs only if the database was opened with a
+// Record prototype. The returned function cancels the subscription.
+// Databases with sorted duplicates cannot be watched, since a key does
+// not identify the record that changed; this fails with ErrInvalid.
+func (db Database) Watch(fn WatchFunc) (cancel func(), err error) {
+	if db.duplicates {
+		err = ErrInvalid
+		return
+	}
+
+	w := &watcher{fn: fn}
+
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+
+	watchers[db.ptr] = append(watchers[db.ptr], w)
+
+	cancel = func() {
+		watchersLock.Lock()
+		defer watchersLock.Unlock()
+
+		ws := watchers[db.ptr]
+		for i := range ws {
+			if ws[i] == w {
+				watchers[db.ptr] = append(ws[:i:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(watchers[db.ptr]) == 0 {
+			delete(watchers, db.ptr)
+		}
+	}
+	return
+}
+
+// Drop all subscriptions to a database.
+func unwatchAll(ptr *C.DB) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+
+	delete(watchers, ptr)
+}
+
+// Check whether anybody is subscribed to changes of the database.
+func (db Database) watched() bool {
+	watchersLock.RLock()
+	defer watchersLock.RUnlock()
+
+	return len(watchers[db.ptr]) > 0
+}
+
+// Create an empty record of the type stored in the database, or nil
+// if the database was opened without a Record prototype.
+func (db Database) newRecord() proto.Message {
+	if db.record == nil {
+		return nil
+	}
+	return reflect.New(db.record).Interface().(proto.Message)
+}
+
+// Fetch the current version of a record for a change notification,
+// or nil if there is none.
+func (db Database) previous(txn Transaction, rec proto.Message) (old proto.Message, err error) {
+	old = proto.Clone(rec)
+
+	err = db.Get(txn, false, old)
+	if IsNotFound(err) {
+		old, err = nil, nil
+	}
+	return
+}
+
+// Classify a change by the presence of the previous and the current
+// record.
+func changeKind(before, after proto.Message) (kind ChangeKind) {
+	switch {
+	case before == nil:
+		kind = Inserted
+	case after == nil:
+		kind = Deleted
+	default:
+		kind = Updated
+	}
+	return
+}
+
+// Check whether changes to the database are watched or logged.
+func (db Database) tracked() bool {
+	return db.changeLog != nil || db.watched()
+}
+
+// Check that a change to the database can be logged before it is
+// made. Changes to a database with a change log require a transaction,
+// so that a change whose entry cannot be appended is undone with it,
+// and their entries must fit into the log; otherwise the operation
+// fails with ErrInvalid. Unless both records are nil, the entry of the
+// change is encoded to check its size.
+func (db Database) checkChange(txn Transaction, before, after proto.Message) (err error) {
+	if db.changeLog == nil {
+		return
+	}
+
+	if txn == NoTransaction {
+		err = ErrInvalid
+		return
+	}
+
+	if before != nil || after != nil {
+		_, err = db.changeLog.entry(db, before, after)
+	}
+	return
+}
+
+// Append a change to the change log of the database, if any, and
+// record it for its watchers. The records passed must not be modified
+// afterwards.
+func (db Database) track(txn Transaction, before, after proto.Message) (err error) {
+	if db.changeLog != nil {
+		err = db.changeLog.append(txn, db, before, after)
+		if err != nil {
+			return
+		}
+	}
+
+	if db.watched() {
+		db.changed(txn, before, after)
+	}
+	return
+}
+
+// Record a change to the database, to be delivered when the
+// transaction commits.
+func (db Database) changed(txn Transaction, before, after proto.Message) {
+	change := Change{Database: db, Kind: changeKind(before, after), Old: before, New: after}
+
+	if txn == NoTransaction {
+		deliver([]Change{change})
+		return
+	}
+
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	pending[txn.ptr] = append(pending[txn.ptr], change)
+}
+
+// Remember a child transaction, so that the changes recorded for it
+// are not left behind if its parent is resolved first.
+func beginChanges(ptr, parent *C.DB_TXN) {
+	if parent == nil {
+		return
+	}
+
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	children[parent] = append(children[parent], ptr)
+}
+
+// Take the changes recorded for a resolved transaction and detach it
+// from its parent.
+func takeChanges(ptr, parent *C.DB_TXN) (changes []Change) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	changes = collectChanges(ptr)
+
+	if parent != nil {
+		siblings := children[parent]
+		for i := range siblings {
+			if siblings[i] == ptr {
+				children[parent] = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+		if len(children[parent]) == 0 {
+			delete(children, parent)
+		}
+	}
+	return
+}
+
+// Take the changes recorded for a transaction and for its unresolved
+// child transactions, which Berkeley DB resolves along with it. The
+// caller must hold pendingLock.
+func collectChanges(ptr *C.DB_TXN) (changes []Change) {
+	changes = pending[ptr]
+	delete(pending, ptr)
+
+	for _, child := range children[ptr] {
+		changes = append(changes, collectChanges(child)...)
+	}
+	delete(children, ptr)
+	return
+}
+
+// Deliver the changes of a committed transaction, or hand them to the
+// parent transaction if there is one.
+func commitChanges(ptr, parent *C.DB_TXN) {
+	changes := takeChanges(ptr, parent)
+	if len(changes) == 0 {
+		return
+	}
+
+	if parent != nil {
+		pendingLock.Lock()
+		defer pendingLock.Unlock()
+
+		pending[parent] = append(pending[parent], changes...)
+		return
+	}
+
+	deliver(changes)
+}
+
+// Discard the changes of an aborted transaction.
+func abortChanges(ptr, parent *C.DB_TXN) {
+	takeChanges(ptr, parent)
+}
+
+// Pass changes to the subscribers of their databases.
+func deliver(changes []Change) {
+	for _, change := range changes {
+		watchersLock.RLock()
+		ws := watchers[change.Database.ptr]
+		watchersLock.RUnlock()
+
+		for _, w := range ws {
+			w.fn(change)
+		}
+	}
+}
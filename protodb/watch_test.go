@@ -0,0 +1,304 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, db Database) {
+		var changes []Change
+		cancel, err := db.Watch(func(change Change) {
+			changes = append(changes, change)
+		})
+		if err != nil {
+			t.Fatal("Watch failed:", err)
+		}
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			err := db.Put(txn, false, rec)
+			if len(changes) != 0 {
+				t.Error("Change delivered before commit:", changes)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		if len(changes) != 1 || changes[0].Kind != Inserted || changes[0].Old != nil {
+			t.Fatal("Insertion not delivered:", changes)
+		}
+
+		abort := errors.New("abort")
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			rec.Val = proto.String("nobody")
+			err := db.Put(txn, false, rec)
+			if err != nil {
+				return err
+			}
+			return abort
+		})
+		if err != abort {
+			t.Error("Aborted transaction failed:", err)
+		}
+		if len(changes) != 1 {
+			t.Error("Change of aborted transaction delivered:", changes)
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return env.WithTransaction(&TransactionConfig{Parent: txn}, func(child Transaction) error {
+				rec.Val = proto.String("again")
+				return db.Put(child, false, rec)
+			})
+		})
+		if err != nil {
+			t.Fatal("Nested put failed:", err)
+		}
+		if len(changes) != 2 || changes[1].Kind != Updated {
+			t.Fatal("Update not delivered:", changes)
+		}
+		if changes[1].Old.(*TestRecord).GetVal() != "world" || changes[1].New.(*TestRecord).GetVal() != "again" {
+			t.Error("Update values mismatch:", changes[1])
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Del(txn, rec)
+		})
+		if err != nil {
+			t.Fatal("Del failed:", err)
+		}
+		if len(changes) != 3 || changes[2].Kind != Deleted || changes[2].New != nil {
+			t.Fatal("Deletion not delivered:", changes)
+		}
+		if changes[2].Old.(*TestRecord).GetVal() != "again" {
+			t.Error("Deleted value mismatch:", changes[2])
+		}
+
+		cancel()
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return db.Put(txn, false, rec)
+		})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		if len(changes) != 3 {
+			t.Error("Change delivered after cancellation:", changes)
+		}
+	})
+}
+
+func TestWatchUnresolvedChild(t *testing.T) {
+	withEnvDb(t, BTree, func(env Environment, db Database) {
+		var changes []Change
+		cancel, err := db.Watch(func(change Change) {
+			changes = append(changes, change)
+		})
+		if err != nil {
+			t.Fatal("Watch failed:", err)
+		}
+		defer cancel()
+
+		// Resolving a parent resolves its open children with it.
+		for _, commit := range []bool{false, true} {
+			parent, err := env.Begin(nil)
+			if err != nil {
+				t.Fatal("Begin failed:", err)
+			}
+			child, err := env.Begin(&TransactionConfig{Parent: parent})
+			if err != nil {
+				t.Fatal("Begin of child failed:", err)
+			}
+
+			err = db.Put(child, false, &TestRecord{
+				Key: &TestRecord_Key{Val: proto.String("hello")},
+				Val: proto.String("world"),
+			})
+			if err != nil {
+				t.Fatal("Put failed:", err)
+			}
+
+			if commit {
+				err = parent.Commit()
+			} else {
+				err = parent.Abort()
+			}
+			if err != nil {
+				t.Fatal("Resolving parent failed:", err)
+			}
+		}
+
+		if len(changes) != 1 || changes[0].Kind != Inserted {
+			t.Error("Changes of unresolved child mismatch:", changes)
+		}
+
+		pendingLock.Lock()
+		n, m := len(pending), len(children)
+		pendingLock.Unlock()
+		if n != 0 || m != 0 {
+			t.Error("Changes of resolved transactions left behind:", n, m)
+		}
+	})
+}
+
+func TestWatchNoTransaction(t *testing.T) {
+	withDbConfig(t, &DatabaseConfig{Create: true, Type: BTree, Record: &TestRecord{}}, func(db Database) {
+		var changes []Change
+		_, err := db.Watch(func(change Change) {
+			changes = append(changes, change)
+		})
+		if err != nil {
+			t.Fatal("Watch failed:", err)
+		}
+
+		rec := &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("hello")},
+			Val: proto.String("world"),
+		}
+
+		err = db.Put(NoTransaction, false, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		if len(changes) != 1 || changes[0].Kind != Inserted {
+			t.Fatal("Insertion not delivered immediately:", changes)
+		}
+
+		err = db.AppendData(NoTransaction, &TestRecord{Key: rec.Key, Val: proto.String("again")})
+		if err != nil {
+			t.Fatal("Append failed:", err)
+		}
+		if len(changes) != 2 || changes[1].Kind != Updated || changes[1].New.(*TestRecord).GetVal() != "again" {
+			t.Fatal("Appended data not delivered:", changes)
+		}
+
+		cur, err := db.Cursor(NoTransaction)
+		if err != nil {
+			t.Fatal("Failed to open cursor:", err)
+		}
+
+		err = cur.First(&TestRecord{})
+		if err == nil {
+			err = cur.Del()
+		}
+		if err != nil {
+			t.Error("Cursor deletion failed:", err)
+		}
+
+		err = cur.Close()
+		if err != nil {
+			t.Error("Failed to close cursor:", err)
+		}
+
+		if len(changes) != 3 || changes[2].Kind != Deleted || changes[2].Old.(*TestRecord).GetVal() != "again" {
+			t.Fatal("Cursor deletion not delivered:", changes)
+		}
+
+		err = db.PutWithTTL(NoTransaction, false, time.Millisecond, rec)
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		n, err := db.DeleteExpired(NoEnvironment, 0)
+		if err != nil || n != 1 {
+			t.Error("Failed to delete expired record:", n, err)
+		}
+		if len(changes) != 5 || changes[4].Kind != Deleted || changes[4].Old.(*TestRecord).GetVal() != "world" {
+			t.Error("Expired deletion not delivered:", changes)
+		}
+	})
+}
+
+func TestWatchConsume(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		var changes []Change
+		_, err := db.Watch(func(change Change) {
+			changes = append(changes, change)
+		})
+		if err != nil {
+			t.Fatal("Watch failed:", err)
+		}
+
+		err = db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String("a")})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		rec := &NumberedTestRecord{}
+		err = db.Consume(NoTransaction, rec, false)
+		if err != nil {
+			t.Fatal("Consume failed:", err)
+		}
+		if len(changes) != 2 || changes[1].Kind != Deleted || changes[1].Old.(*NumberedTestRecord).GetVal() != "a" {
+			t.Error("Consumption not delivered:", changes)
+		}
+	})
+}
+
+func TestWatchGetConsume(t *testing.T) {
+	withDbConfig(t, queueConfig, func(db Database) {
+		var changes []Change
+		_, err := db.Watch(func(change Change) {
+			changes = append(changes, change)
+		})
+		if err != nil {
+			t.Fatal("Watch failed:", err)
+		}
+
+		err = db.PutWithTTL(NoTransaction, true, time.Millisecond, &NumberedTestRecord{Val: proto.String("a")})
+		if err != nil {
+			t.Fatal("Put with TTL failed:", err)
+		}
+		err = db.Put(NoTransaction, true, &NumberedTestRecord{Val: proto.String("b")})
+		if err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		rec := &NumberedTestRecord{}
+		err = db.Get(NoTransaction, true, rec)
+		if err != nil || rec.GetVal() != "b" {
+			t.Fatal("Consuming get did not skip expired record:", rec, err)
+		}
+		if len(changes) != 4 || changes[2].Kind != Deleted || changes[3].Kind != Deleted {
+			t.Fatal("Consumption not delivered:", changes)
+		}
+		if changes[2].Old.(*NumberedTestRecord).GetVal() != "a" || changes[3].Old.(*NumberedTestRecord).GetVal() != "b" {
+			t.Error("Consumed values mismatch:", changes[2], changes[3])
+		}
+	})
+}
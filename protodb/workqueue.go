@@ -0,0 +1,454 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Record of a job stored in a work queue.
+type queueJob struct {
+	Key              *uint32 `protobuf:"fixed32,1,opt,name=key"`
+	Payload          []byte  `protobuf:"bytes,2,opt,name=payload"`
+	Attempts         *uint32 `protobuf:"varint,3,opt,name=attempts"`
+	VisibleAt        *int64  `protobuf:"varint,4,opt,name=visible_at"`
+	Lease            *uint64 `protobuf:"fixed64,5,opt,name=lease"`
+	XXX_unrecognized []byte
+}
+
+func (job *queueJob) Reset()         { *job = queueJob{} }
+func (job *queueJob) String() string { return proto.CompactTextString(job) }
+func (*queueJob) ProtoMessage()      {}
+
+func (job *queueJob) GetAttempts() uint32 {
+	if job != nil && job.Attempts != nil {
+		return *job.Attempts
+	}
+	return 0
+}
+
+func (job *queueJob) GetVisibleAt() int64 {
+	if job != nil && job.VisibleAt != nil {
+		return *job.VisibleAt
+	}
+	return 0
+}
+
+func (job *queueJob) GetLease() uint64 {
+	if job != nil && job.Lease != nil {
+		return *job.Lease
+	}
+	return 0
+}
+
+// Error returned when acknowledging or rejecting a job that has been
+// delivered again or removed since it was taken.
+var ErrLeaseLost = errors.New("protodb: job lease lost")
+
+// Work queue configuration.
+type WorkQueueConfig struct {
+	VisibilityTimeout time.Duration // Time until an unacknowledged job is delivered again.
+	MaxAttempts       uint32        // Number of deliveries before a job is dead-lettered, unlimited if zero.
+	PollInterval      time.Duration // Delay between checks for new jobs while waiting.
+	DeadLetters       Database      // Queue database receiving failed jobs, if any.
+}
+
+// Default work queue configuration.
+var defaultWorkQueueConfig = WorkQueueConfig{
+	VisibilityTimeout: 30 * time.Second,
+	PollInterval:      100 * time.Millisecond,
+}
+
+// Job taken from a work queue.
+type Job struct {
+	ID       uint32 // Record number of the job.
+	Attempts uint32 // Number of deliveries of the job, including this one.
+	Lease    uint64 // Token identifying this delivery of the job.
+	Payload  []byte // Encoded payload of the job.
+}
+
+// Decode the payload of the job.
+func (job *Job) Decode(payload proto.Message) error {
+	return proto.Unmarshal(job.Payload, payload)
+}
+
+// Queue of jobs that are acknowledged after processing. Dequeued jobs
+// stay in the underlying queue database, invisible to other consumers
+// until they are acknowledged or their visibility timeout expires, so
+// no job is lost if a consumer crashes.
+//
+// A work queue remembers up to which job the queue held only invisible
+// jobs and resumes its search there until the first of them becomes
+// visible again, so jobs rejected through another WorkQueue value may
+// be delivered by this one only after their visibility timeout.
+type WorkQueue struct {
+	env    Environment
+	jobs   Database
+	config WorkQueueConfig
+
+	scanLock  sync.Mutex
+	scanFrom  uint32 // Job to resume the search for visible jobs at.
+	scanUntil int64  // Time until all jobs before scanFrom are invisible.
+	scanEpoch uint64 // Generation of the search state, bumped by Nack.
+}
+
+// Length of the bookkeeping fields of a job record with an empty
+// payload, including the prefix of padded data.
+var queueJobOverhead = paddedPrefixSize + proto.Size(&queueJob{
+	Key:       proto.Uint32(math.MaxUint32),
+	Payload:   []byte{},
+	Attempts:  proto.Uint32(math.MaxUint32),
+	VisibleAt: proto.Int64(math.MaxInt64),
+	Lease:     proto.Uint64(math.MaxUint64),
+})
+
+// Create a work queue on top of a queue database in a transactional
+// environment. The records of the queue database must be long enough
+// to hold the largest job payload plus a few bytes of bookkeeping;
+// compression and transformers cannot be used with it. The same holds
+// for the dead letter database, if any. Otherwise the operation fails
+// with ErrInvalid.
+func NewWorkQueue(env Environment, jobs Database, config *WorkQueueConfig) (wq *WorkQueue, err error) {
+	ok, err := env.transactional()
+	if err != nil {
+		return
+	} else if !ok {
+		err = ErrInvalid
+		return
+	}
+
+	_, err = jobs.queueCapacity(queueJobOverhead)
+	if err != nil {
+		return
+	}
+
+	q := &WorkQueue{env: env, jobs: jobs, config: defaultWorkQueueConfig}
+
+	if config != nil {
+		if config.VisibilityTimeout != 0 {
+			q.config.VisibilityTimeout = config.VisibilityTimeout
+		}
+		if config.MaxAttempts != 0 {
+			q.config.MaxAttempts = config.MaxAttempts
+		}
+		if config.PollInterval != 0 {
+			q.config.PollInterval = config.PollInterval
+		}
+		if config.DeadLetters.ptr != nil {
+			_, err = config.DeadLetters.queueCapacity(queueJobOverhead)
+			if err != nil {
+				return
+			}
+
+			q.config.DeadLetters = config.DeadLetters
+			q.config.DeadLetters.codec = PaddedCodec(config.DeadLetters.dataCodec())
+		}
+	}
+
+	q.jobs.codec = PaddedCodec(jobs.dataCodec())
+
+	wq = q
+	return
+}
+
+// Add a job to the queue.
+func (wq *WorkQueue) Enqueue(txn Transaction, payload proto.Message) (id uint32, err error) {
+	buf, err := proto.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	rec := &queueJob{Payload: buf, Attempts: proto.Uint32(0), VisibleAt: proto.Int64(0)}
+	err = wq.jobs.Put(txn, true, rec)
+	if err == nil {
+		id = *rec.Key
+	}
+
+	return
+}
+
+// Move a job to the dead-letter database, if any, and remove it from
+// the queue.
+func (wq *WorkQueue) bury(txn Transaction, rec *queueJob) (err error) {
+	if wq.config.DeadLetters.ptr != nil {
+		dead := &queueJob{Payload: rec.Payload, Attempts: rec.Attempts, VisibleAt: proto.Int64(0)}
+		err = wq.config.DeadLetters.Put(txn, true, dead)
+		if err != nil {
+			return
+		}
+	}
+
+	err = wq.jobs.Del(txn, rec)
+	return
+}
+
+// Check whether the first record number precedes the second one.
+// Record numbers of a queue wrap around, so the comparison holds as
+// long as the queue spans less than half of the number space.
+func recnoBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// Position a cursor at the first job whose identifier is at least the
+// given one, in the order of the queue.
+func (wq *WorkQueue) seek(cur Cursor, rec *queueJob, id uint32) (err error) {
+	if id == 0 {
+		err = cur.First(rec)
+		return
+	}
+
+	for {
+		rec.Key = proto.Uint32(id)
+		err = cur.Set(rec, true)
+		if !errors.Is(err, ErrKeyEmpty) {
+			break
+		}
+		id++
+		if id == 0 {
+			id = 1
+		}
+	}
+
+	// The identifier lies either past the end of the queue or before
+	// its head, where the search has to start instead.
+	if errors.Is(err, ErrNotFound) {
+		err = cur.Last(rec)
+		if err == nil && recnoBefore(*rec.Key, id) {
+			err = ErrNotFound
+		} else if err == nil {
+			err = cur.First(rec)
+		}
+	}
+
+	return
+}
+
+// Take the first visible job starting from the given one and make it
+// invisible for the visibility timeout. Jobs that have exhausted their
+// attempts are dead-lettered on the way. Also returns the job to
+// resume the next search at and the time until which all jobs passed
+// remain invisible.
+func (wq *WorkQueue) take(txn Transaction, from uint32) (job *Job, next uint32, hidden int64, err error) {
+	cur, err := wq.jobs.Cursor(txn)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	rec := &queueJob{}
+
+	next, hidden = from, math.MaxInt64
+
+	for err = wq.seek(cur, rec, from); err == nil; err = cur.Next(rec) {
+		next = *rec.Key + 1
+
+		if visible := rec.GetVisibleAt(); visible > now {
+			if visible < hidden {
+				hidden = visible
+			}
+			continue
+		}
+
+		if wq.config.MaxAttempts != 0 && rec.GetAttempts() >= wq.config.MaxAttempts {
+			err = wq.bury(txn, rec)
+			if err != nil {
+				break
+			}
+			continue
+		}
+
+		rec.Attempts = proto.Uint32(rec.GetAttempts() + 1)
+		rec.VisibleAt = proto.Int64(now + int64(wq.config.VisibilityTimeout))
+		rec.Lease = proto.Uint64(rand.Uint64())
+
+		err = wq.jobs.Put(txn, false, rec)
+		if err == nil {
+			job = &Job{ID: *rec.Key, Attempts: *rec.Attempts, Lease: *rec.Lease, Payload: rec.Payload}
+			if *rec.VisibleAt < hidden {
+				hidden = *rec.VisibleAt
+			}
+		}
+		break
+	}
+	if IsNotFound(err) {
+		err = nil
+	}
+
+	cerr := cur.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return
+}
+
+// Get the job to resume the search for visible jobs at, the time until
+// which all jobs before it are invisible and the generation of this
+// information.
+func (wq *WorkQueue) resumption() (from uint32, until int64, epoch uint64) {
+	wq.scanLock.Lock()
+	defer wq.scanLock.Unlock()
+
+	if time.Now().UnixNano() < wq.scanUntil {
+		from, until = wq.scanFrom, wq.scanUntil
+	} else {
+		until = math.MaxInt64
+	}
+	epoch = wq.scanEpoch
+	return
+}
+
+// Record the result of a committed search, unless the search state
+// has been reset in the meantime.
+func (wq *WorkQueue) resume(from uint32, until int64, epoch uint64) {
+	wq.scanLock.Lock()
+	defer wq.scanLock.Unlock()
+
+	if epoch == wq.scanEpoch {
+		wq.scanFrom, wq.scanUntil = from, until
+	}
+}
+
+// Make the next search start at the head of the queue.
+func (wq *WorkQueue) rescan() {
+	wq.scanLock.Lock()
+	defer wq.scanLock.Unlock()
+
+	wq.scanFrom, wq.scanUntil = 0, 0
+	wq.scanEpoch++
+}
+
+// Wait for a job and take it from the queue. The job must be
+// acknowledged with Ack once it has been processed, otherwise it is
+// delivered again after the visibility timeout. Attempts failing due
+// to a lock conflict are retried after a short delay.
+func (wq *WorkQueue) Dequeue(ctx context.Context) (job *Job, err error) {
+	var poll *time.Timer
+
+	attempt := 0
+	for {
+		from, until, epoch := wq.resumption()
+
+		var taken *Job
+		var next uint32
+		var hidden int64
+		err = wq.env.WithTransaction(nil, func(txn Transaction) (err error) {
+			taken, next, hidden, err = wq.take(txn, from)
+			return
+		})
+
+		// A job taken by a transaction that failed to commit is still
+		// visible and must not be handed out.
+		wait := wq.config.PollInterval
+		if err == nil {
+			if hidden < until {
+				until = hidden
+			}
+			wq.resume(next, until, epoch)
+
+			if taken != nil {
+				job = taken
+				return
+			}
+			attempt = 0
+		} else if IsRetryable(err) {
+			wait = retryDelay(attempt)
+			attempt++
+		} else {
+			return
+		}
+
+		if poll == nil {
+			poll = time.NewTimer(wait)
+			defer poll.Stop()
+		} else {
+			poll.Reset(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// Fetch the record of a job, provided that the delivery still holds
+// the lease on it.
+func (wq *WorkQueue) leased(txn Transaction, job *Job) (rec *queueJob, err error) {
+	rec = &queueJob{Key: proto.Uint32(job.ID)}
+	err = wq.jobs.Get(txn, false, rec)
+	if IsNotFound(err) || err == nil && rec.GetLease() != job.Lease {
+		err = ErrLeaseLost
+	}
+	return
+}
+
+// Acknowledge a processed job, removing it from the queue. Passing the
+// transaction that recorded the results of the job makes processing
+// and acknowledgement atomic. Fails with ErrLeaseLost if the job has
+// been delivered again in the meantime.
+func (wq *WorkQueue) Ack(txn Transaction, job *Job) (err error) {
+	rec, err := wq.leased(txn, job)
+	if err != nil {
+		return
+	}
+
+	err = wq.jobs.Del(txn, rec)
+	return
+}
+
+// Reject a job that could not be processed, making it visible again
+// immediately. A job that has exhausted its attempts is moved to the
+// dead-letter database instead. Fails with ErrLeaseLost if the job has
+// been delivered again in the meantime.
+func (wq *WorkQueue) Nack(txn Transaction, job *Job) (err error) {
+	rec, err := wq.leased(txn, job)
+	if err != nil {
+		return
+	}
+
+	if wq.config.MaxAttempts != 0 && rec.GetAttempts() >= wq.config.MaxAttempts {
+		err = wq.bury(txn, rec)
+		return
+	}
+
+	rec.VisibleAt = proto.Int64(0)
+	rec.Lease = nil
+	err = wq.jobs.Put(txn, false, rec)
+	if err == nil {
+		wq.rescan()
+	}
+
+	return
+}
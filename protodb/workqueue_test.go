@@ -0,0 +1,315 @@
+/* -*- mode: Go; coding: utf-8; -*-
+ * This file is part of goprotodb.
+ * Copyright (C) 2012 Thomas Chust <chust@web.de>.  All rights reserved.
+ *
+ * Permission is hereby granted, free of charge, to any person
+ * obtaining a copy of this software and associated documentation
+ * files (the Software), to deal in the Software without restriction,
+ * including without limitation the rights to use, copy, modify,
+ * merge, publish, distribute, sublicense, and/or sell copies of the
+ * Software, and to permit persons to whom the Software is furnished
+ * to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be
+ * included in all copies or substantial portions of the Software.
+ * 
+ * THE SOFTWARE IS PROVIDED ASIS, WITHOUT WARRANTY OF ANY KIND,
+ * EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+ * MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+ * NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS
+ * BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN
+ * ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+ * CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package protodb
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// Open an in-memory queue database for jobs.
+func openJobQueue(t *testing.T, env Environment, name string) (db Database) {
+	err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+		db, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+			Create:       true,
+			Type:         Queue,
+			Name:         name,
+			InMemory:     true,
+			RecordLength: 128,
+		})
+		return
+	})
+	if err != nil {
+		t.Fatal("Failed to open queue database:", err)
+	}
+
+	return
+}
+
+// Create a work queue, failing the test on errors.
+func newWorkQueue(t *testing.T, env Environment, jobs Database, config *WorkQueueConfig) (wq *WorkQueue) {
+	wq, err := NewWorkQueue(env, jobs, config)
+	if err != nil {
+		t.Fatal("Failed to create work queue:", err)
+	}
+
+	return
+}
+
+// Enqueue a test record as a job.
+func enqueueJob(t *testing.T, env Environment, wq *WorkQueue, val string) (id uint32) {
+	err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+		id, err = wq.Enqueue(txn, &TestRecord{
+			Key: &TestRecord_Key{Val: proto.String("job")},
+			Val: proto.String(val),
+		})
+		return
+	})
+	if err != nil {
+		t.Fatal("Enqueue failed:", err)
+	}
+
+	return
+}
+
+// Check that no job can be taken from a queue.
+func expectNoJob(t *testing.T, wq *WorkQueue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	job, err := wq.Dequeue(ctx)
+	if err != context.DeadlineExceeded {
+		t.Error("Dequeue from empty queue did not time out:", job, err)
+	}
+}
+
+func TestWorkQueue(t *testing.T) {
+	withEnv(t, func(env Environment) {
+		jobs := openJobQueue(t, env, "jobs")
+		defer jobs.Close()
+		dead := openJobQueue(t, env, "dead")
+		defer dead.Close()
+
+		wq := newWorkQueue(t, env, jobs, &WorkQueueConfig{
+			VisibilityTimeout: 50 * time.Millisecond,
+			MaxAttempts:       2,
+			PollInterval:      10 * time.Millisecond,
+			DeadLetters:       dead,
+		})
+		buried := newWorkQueue(t, env, dead, nil)
+
+		id := enqueueJob(t, env, wq, "world")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		first, err := wq.Dequeue(ctx)
+		if err != nil {
+			t.Fatal("Dequeue failed:", err)
+		}
+		if first.ID != id || first.Attempts != 1 {
+			t.Error("Dequeued job mismatch:", first)
+		}
+
+		rec := &TestRecord{}
+		err = first.Decode(rec)
+		if err != nil || rec.GetVal() != "world" {
+			t.Error("Job payload mismatch:", rec, err)
+		}
+
+		// Not acknowledged, so delivered again after the timeout.
+		job, err := wq.Dequeue(ctx)
+		if err != nil {
+			t.Fatal("Dequeue failed:", err)
+		}
+		if job.ID != id || job.Attempts != 2 {
+			t.Error("Redelivered job mismatch:", job)
+		}
+
+		// The first delivery has lost its lease.
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return wq.Ack(txn, first)
+		})
+		if !errors.Is(err, ErrLeaseLost) {
+			t.Error("Acknowledgement of stale delivery not rejected:", err)
+		}
+
+		// Out of attempts, so dead-lettered.
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return wq.Nack(txn, job)
+		})
+		if err != nil {
+			t.Error("Nack failed:", err)
+		}
+
+		expectNoJob(t, wq)
+
+		job, err = buried.Dequeue(ctx)
+		if err != nil {
+			t.Fatal("Dequeue of dead letter failed:", err)
+		}
+		err = job.Decode(rec)
+		if err != nil || rec.GetVal() != "world" {
+			t.Error("Dead letter payload mismatch:", rec, err)
+		}
+
+		enqueueJob(t, env, wq, "again")
+
+		job, err = wq.Dequeue(ctx)
+		if err != nil {
+			t.Fatal("Dequeue failed:", err)
+		}
+
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return wq.Ack(txn, job)
+		})
+		if err != nil {
+			t.Error("Ack failed:", err)
+		}
+
+		expectNoJob(t, wq)
+	})
+}
+
+func TestWorkQueueOrder(t *testing.T) {
+	withEnv(t, func(env Environment) {
+		jobs := openJobQueue(t, env, "jobs")
+		defer jobs.Close()
+
+		wq := newWorkQueue(t, env, jobs, &WorkQueueConfig{
+			PollInterval: 10 * time.Millisecond,
+		})
+
+		ids := []uint32{
+			enqueueJob(t, env, wq, "a"),
+			enqueueJob(t, env, wq, "b"),
+			enqueueJob(t, env, wq, "c"),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var taken []*Job
+		for i := range ids {
+			job, err := wq.Dequeue(ctx)
+			if err != nil {
+				t.Fatal("Dequeue failed:", err)
+			}
+			if job.ID != ids[i] {
+				t.Error("Jobs dequeued out of order:", job.ID, ids[i])
+			}
+			taken = append(taken, job)
+
+			// Leave a gap behind the first job.
+			if i == 0 {
+				err = env.WithTransaction(nil, func(txn Transaction) error {
+					return wq.Ack(txn, job)
+				})
+				if err != nil {
+					t.Error("Ack failed:", err)
+				}
+			}
+		}
+
+		expectNoJob(t, wq)
+
+		// Jobs added after the taken ones are found.
+		id := enqueueJob(t, env, wq, "d")
+		job, err := wq.Dequeue(ctx)
+		if err != nil || job.ID != id {
+			t.Error("Dequeue of new job failed:", job, err)
+		}
+
+		// Rejected jobs are found again.
+		err = env.WithTransaction(nil, func(txn Transaction) error {
+			return wq.Nack(txn, taken[1])
+		})
+		if err != nil {
+			t.Error("Nack failed:", err)
+		}
+
+		job, err = wq.Dequeue(ctx)
+		if err != nil || job.ID != ids[1] || job.Attempts != 2 {
+			t.Error("Rejected job not delivered again:", job, err)
+		}
+	})
+}
+
+func TestWorkQueueRejected(t *testing.T) {
+	withEnv(t, func(env Environment) {
+		jobs := openJobQueue(t, env, "jobs")
+		defer jobs.Close()
+
+		var short, tree Database
+		err := env.WithTransaction(nil, func(txn Transaction) (err error) {
+			short, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:       true,
+				Type:         Queue,
+				Name:         "short",
+				InMemory:     true,
+				RecordLength: 16,
+			})
+			if err != nil {
+				return
+			}
+			tree, err = OpenDatabase(env, txn, "", &DatabaseConfig{
+				Create:   true,
+				Type:     BTree,
+				Name:     "tree",
+				InMemory: true,
+			})
+			return
+		})
+		if err != nil {
+			t.Fatal("Failed to open databases:", err)
+		}
+		defer short.Close()
+		defer tree.Close()
+
+		_, err = NewWorkQueue(NoEnvironment, jobs, nil)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Work queue without environment not rejected:", err)
+		}
+
+		_, err = NewWorkQueue(env, tree, nil)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Work queue on B-tree not rejected:", err)
+		}
+
+		_, err = NewWorkQueue(env, short, nil)
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Work queue with short records not rejected:", err)
+		}
+
+		_, err = NewWorkQueue(env, jobs, &WorkQueueConfig{DeadLetters: tree})
+		if !errors.Is(err, ErrInvalid) {
+			t.Error("Dead letters in B-tree not rejected:", err)
+		}
+	})
+}
+
+func TestRecnoOrder(t *testing.T) {
+	pairs := [][2]uint32{
+		{1, 2},
+		{41, 4000},
+		{math.MaxUint32 - 1, math.MaxUint32},
+		{math.MaxUint32, 1},
+		{math.MaxUint32 - 10, 10},
+	}
+
+	for _, p := range pairs {
+		if !recnoBefore(p[0], p[1]) || recnoBefore(p[1], p[0]) {
+			t.Error("Record numbers out of order:", p[0], p[1])
+		}
+	}
+	if recnoBefore(7, 7) {
+		t.Error("Record number precedes itself")
+	}
+}